@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -24,6 +25,31 @@ type AnsibleConfig struct {
 	InventoryList []string   // Paths to all desired inventories
 }
 
+// Matches the version in the first line of ansible-playbook --version,
+// e.g. "ansible-playbook [core 2.15.0]" or "ansible-playbook 2.9.27"
+var ansibleVersionPattern = regexp.MustCompile(`\d+\.\d+[0-9A-Za-z.+-]*`)
+
+// Version returns the version of Ansible that runs the playbooks
+func (a AnsibleConfig) Version() (string, error) {
+	vCmd := VenvCommand{
+		Config: a.VenvConfig,
+		Binary: "ansible-playbook",
+		Args:   []string{"--version"},
+	}
+	venvCommandOutput := vCmd.Run()
+	if venvCommandOutput.Error != nil {
+		return "", errors.Wrap(venvCommandOutput.Error, "unable to execute ansible-playbook version command")
+	}
+
+	firstLine := strings.SplitN(venvCommandOutput.Stdout, "\n", 2)[0]
+	version := ansibleVersionPattern.FindString(firstLine)
+	if version == "" {
+		return "", errors.Errorf("unexpected output from ansible-playbook version command: %s", firstLine)
+	}
+
+	return version, nil
+}
+
 // CreateAnsibleTargetsList generates and returns an array of possible targets
 // The possible targets are ip addresses from the host interfaces or the hostname itself
 func CreateAnsibleTargetsList() ([]string, error) {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 
@@ -29,3 +31,26 @@ func TestHostnameLookup(t *testing.T) {
 	}
 	assert.True(t, found, "one of the targets should be an ip address")
 }
+
+func TestAnsibleVersion(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ansible_puller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	prefix := filepath.Join(tmpDir, "prefix")
+	writeScript(t, filepath.Join(prefix, "bin", "ansible-playbook"), `printf "ansible-playbook [core 2.15.0]\n  python version = 3.11.2\n"`)
+	version, err := AnsibleConfig{VenvConfig: VenvConfig{Disabled: true, Prefix: prefix}}.Version()
+	assert.Nil(t, err)
+	assert.Equal(t, "2.15.0", version)
+
+	// Without a prefix, ansible-playbook is run from $PATH
+	path := filepath.Join(tmpDir, "path")
+	writeScript(t, filepath.Join(path, "ansible-playbook"), `echo "ansible-playbook 2.9.27"`)
+	t.Setenv("PATH", path+":"+os.Getenv("PATH"))
+	version, err = AnsibleConfig{VenvConfig: VenvConfig{Disabled: true}}.Version()
+	assert.Nil(t, err)
+	assert.Equal(t, "2.9.27", version)
+
+	_, err = AnsibleConfig{VenvConfig: VenvConfig{Path: filepath.Join(tmpDir, "missing")}}.Version()
+	assert.NotNil(t, err)
+}
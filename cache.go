@@ -0,0 +1,347 @@
+// Content-addressed cache of pulled Ansible tarballs
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Digest algorithm used to address bundles in the cache
+	bundleCacheAlgorithm = "sha256"
+	// File in the cache dir that records the digest of the last successfully applied bundle
+	bundleCacheAppliedFile = "applied"
+	// File in the cache dir that records the pinned S3 object version, so that a pin survives restarts.
+	// It has no .json extension, as those are bundle metadata.
+	bundleCacheS3PinFile = "s3-pin"
+	// File in the cache dir that records the digest of the pinned bundle, so that a rollback survives restarts
+	bundleCachePinFile = "pinned"
+)
+
+// s3Pin is an S3 object version that the S3 sources, or the one named by Source, are pinned to
+type s3Pin struct {
+	Version string `json:"version"`
+	Source  string `json:"source,omitempty"`
+}
+
+// bundleCacheEntry describes a tarball in the bundle cache
+type bundleCacheEntry struct {
+	Digest  string    `json:"digest"`            // SHA-256 of the tarball
+	Source  string    `json:"source"`            // Source the tarball was pulled from
+	Version string    `json:"version,omitempty"` // Version of the source, if it is versioned
+	Pulled  time.Time `json:"pulled"`            // Last time the tarball was pulled
+	Applied bool      `json:"applied"`           // Whether this is the last successfully applied tarball
+}
+
+// bundleCache keeps the last few pulled tarballs, keyed by their digest, so that a host can be rolled back
+// to a previous tarball without republishing it.
+type bundleCache struct {
+	Dir  string // Directory holding the tarballs and their metadata
+	Keep int    // Number of tarballs to keep, the last applied one is always kept in addition
+}
+
+// isBundleDigest returns whether digest is a hex SHA-256 digest, as the bundles are addressed by
+func isBundleDigest(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// Path returns the path of the tarball with the given digest. It has no extension, as bundles come in several formats.
+func (c bundleCache) Path(digest string) string {
+	return filepath.Join(c.Dir, digest)
+}
+
+// MigrateLegacy renames tarballs that were stored as <digest>.tgz, whatever their format, to their current path.
+// It is called once at startup, so that reading the cache never changes it.
+func (c bundleCache) MigrateLegacy() error {
+	legacyFiles, err := filepath.Glob(filepath.Join(c.Dir, "*.tgz"))
+	if err != nil {
+		return err
+	}
+
+	for _, legacyFile := range legacyFiles {
+		digest := strings.TrimSuffix(filepath.Base(legacyFile), ".tgz")
+		if !isBundleDigest(digest) {
+			continue
+		}
+
+		logrus.Debugf("Renaming cached bundle %s to %s", legacyFile, c.Path(digest))
+		if err := os.Rename(legacyFile, c.Path(digest)); err != nil {
+			return errors.Wrap(err, "unable to rename cached bundle")
+		}
+	}
+
+	return nil
+}
+
+func (c bundleCache) metadataPath(digest string) string {
+	return filepath.Join(c.Dir, digest+".json")
+}
+
+// Add stores the tarball at path in the cache, along with where it came from, and prunes old tarballs.
+func (c bundleCache) Add(path, source, version string) (bundleCacheEntry, error) {
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return bundleCacheEntry{}, errors.Wrap(err, "unable to create bundle cache dir")
+	}
+
+	digest, err := fileChecksum(path, bundleCacheAlgorithm)
+	if err != nil {
+		return bundleCacheEntry{}, errors.Wrap(err, "unable to hash bundle")
+	}
+
+	if _, err := os.Stat(c.Path(digest)); os.IsNotExist(err) {
+		logrus.Infof("Adding bundle %s to the cache", digest)
+		if err := copyFileAtomic(path, c.Path(digest)); err != nil {
+			return bundleCacheEntry{}, errors.Wrap(err, "unable to store bundle")
+		}
+	} else if err != nil {
+		return bundleCacheEntry{}, err
+	}
+
+	entry := bundleCacheEntry{
+		Digest:  digest,
+		Source:  source,
+		Version: version,
+		Pulled:  time.Now().UTC(),
+	}
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return bundleCacheEntry{}, err
+	}
+	if err := writeFileAtomic(c.metadataPath(digest), metadata, 0600); err != nil {
+		return bundleCacheEntry{}, errors.Wrap(err, "unable to store bundle metadata")
+	}
+
+	if err := c.prune(); err != nil {
+		logrus.Warnln("Unable to prune the bundle cache: ", err)
+	}
+
+	return entry, nil
+}
+
+// List returns all cached tarballs, most recently pulled first.
+func (c bundleCache) List() ([]bundleCacheEntry, error) {
+	applied, err := c.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	metadataFiles, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []bundleCacheEntry{}
+	for _, metadataFile := range metadataFiles {
+		data, err := ioutil.ReadFile(metadataFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry bundleCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse bundle metadata %s", metadataFile)
+		}
+		if !isBundleDigest(entry.Digest) {
+			logrus.Warnf("Ignoring %s, which is not bundle metadata", metadataFile)
+			continue
+		}
+		if _, err := os.Stat(c.Path(entry.Digest)); err != nil {
+			continue
+		}
+
+		entry.Applied = entry.Digest == applied
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Pulled.After(entries[j].Pulled)
+	})
+
+	return entries, nil
+}
+
+// Get looks up a cached tarball by its digest, or by an unambiguous prefix of it.
+func (c bundleCache) Get(digest string) (bundleCacheEntry, error) {
+	digest = strings.ToLower(strings.TrimPrefix(digest, bundleCacheAlgorithm+":"))
+	if digest == "" {
+		return bundleCacheEntry{}, errors.New("no bundle digest given")
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		return bundleCacheEntry{}, err
+	}
+
+	var matches []bundleCacheEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Digest, digest) {
+			matches = append(matches, entry)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return bundleCacheEntry{}, fmt.Errorf("bundle %s not found in the cache", digest)
+	case 1:
+		return matches[0], nil
+	default:
+		return bundleCacheEntry{}, fmt.Errorf("bundle digest prefix %s is ambiguous", digest)
+	}
+}
+
+// MarkApplied records the tarball with the given digest as the last one that was applied successfully.
+func (c bundleCache) MarkApplied(digest string) error {
+	// Streamed bundles are applied without ever being added to the cache
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Wrap(err, "unable to create bundle cache dir")
+	}
+
+	return writeFileAtomic(filepath.Join(c.Dir, bundleCacheAppliedFile), []byte(digest), 0600)
+}
+
+// Applied returns the digest of the last successfully applied tarball, if any.
+func (c bundleCache) Applied() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Dir, bundleCacheAppliedFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AppliedAt returns when a tarball was last applied successfully, or the zero time if none was
+func (c bundleCache) AppliedAt() (time.Time, error) {
+	info, err := os.Stat(filepath.Join(c.Dir, bundleCacheAppliedFile))
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	// The file is rewritten after every successful run, even if the tarball did not change
+	return info.ModTime(), nil
+}
+
+// SavePin records the digest of the pinned bundle, an empty digest removes the pin
+func (c bundleCache) SavePin(digest string) error {
+	path := filepath.Join(c.Dir, bundleCachePinFile)
+	if digest == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Wrap(err, "unable to create bundle cache dir")
+	}
+
+	return writeFileAtomic(path, []byte(digest), 0600)
+}
+
+// Pinned returns the digest of the pinned bundle, if any
+func (c bundleCache) Pinned() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Dir, bundleCachePinFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SaveS3Pin records the pinned S3 object version, an empty version removes the pin
+func (c bundleCache) SaveS3Pin(pin s3Pin) error {
+	path := filepath.Join(c.Dir, bundleCacheS3PinFile)
+	if pin.Version == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return errors.Wrap(err, "unable to create bundle cache dir")
+	}
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0600)
+}
+
+// S3Pin returns the pinned S3 object version, if any
+func (c bundleCache) S3Pin() (s3Pin, error) {
+	var pin s3Pin
+
+	data, err := ioutil.ReadFile(filepath.Join(c.Dir, bundleCacheS3PinFile))
+	if os.IsNotExist(err) {
+		return pin, nil
+	} else if err != nil {
+		return pin, err
+	}
+	err = json.Unmarshal(data, &pin)
+
+	return pin, err
+}
+
+// prune removes all but the Keep most recently pulled tarballs, never removing the last applied one.
+func (c bundleCache) prune() error {
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+
+	// The tarball that was just added must survive
+	keep := c.Keep
+	if keep < 1 {
+		keep = 1
+	}
+
+	kept := 0
+	for _, entry := range entries {
+		if kept < keep {
+			kept++
+			continue
+		}
+		if entry.Applied {
+			continue
+		}
+
+		logrus.Debugf("Pruning bundle %s from the cache", entry.Digest)
+		if err := c.Remove(entry.Digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the tarball with the given digest from the cache
+func (c bundleCache) Remove(digest string) error {
+	if err := os.Remove(c.Path(digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(c.metadataPath(digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
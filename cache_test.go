@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestBundleCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(BundleCacheTestSuite))
+}
+
+type BundleCacheTestSuite struct {
+	suite.Suite
+	tmpDir string
+	cache  bundleCache
+}
+
+func (s *BundleCacheTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.cache = bundleCache{Dir: filepath.Join(s.tmpDir, "bundles"), Keep: 2}
+}
+
+func (s *BundleCacheTestSuite) TearDownTest() {
+	os.RemoveAll(s.tmpDir)
+}
+
+// add writes content to a download file and adds it to the cache
+func (s *BundleCacheTestSuite) add(content []byte, source string) bundleCacheEntry {
+	download := filepath.Join(s.tmpDir, "download.tgz")
+	assert.Nil(s.T(), ioutil.WriteFile(download, content, 0600))
+
+	entry, err := s.cache.Add(download, source, "")
+	assert.Nil(s.T(), err)
+
+	return entry
+}
+
+func (s *BundleCacheTestSuite) TestAddIsContentAddressed() {
+	entry := s.add(testText, "mirror")
+	assert.Equal(s.T(), "f6c1706ecdb494224b49d863788e3724b19275df13afbd676f34b3d6f9bdbe37", entry.Digest)
+
+	text, err := ioutil.ReadFile(s.cache.Path(entry.Digest))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+
+	// The same content from another source is stored once
+	s.add(testText, "s3")
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 1)
+	assert.Equal(s.T(), "s3", entries[0].Source)
+}
+
+func (s *BundleCacheTestSuite) TestMigrateLegacy() {
+	entry := s.add(testText, "mirror")
+	assert.Equal(s.T(), filepath.Join(s.cache.Dir, entry.Digest), s.cache.Path(entry.Digest))
+	assert.Nil(s.T(), os.Rename(s.cache.Path(entry.Digest), s.cache.Path(entry.Digest)+".tgz"))
+
+	// Listing the cache does not touch it
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), entries)
+
+	assert.Nil(s.T(), s.cache.MigrateLegacy())
+	found, err := s.cache.Get(entry.Digest)
+	assert.Nil(s.T(), err, "tarballs with the former .tgz name should be renamed")
+	text, err := ioutil.ReadFile(s.cache.Path(found.Digest))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+
+	// Nothing to do when the cache does not exist yet
+	assert.Nil(s.T(), bundleCache{Dir: filepath.Join(s.tmpDir, "missing")}.MigrateLegacy())
+}
+
+func (s *BundleCacheTestSuite) TestPruneKeepsApplied() {
+	applied := s.add([]byte("first"), "mirror")
+	assert.Nil(s.T(), s.cache.MarkApplied(applied.Digest))
+
+	s.add([]byte("second"), "mirror")
+	s.add([]byte("third"), "mirror")
+	fourth := s.add([]byte("fourth"), "mirror")
+
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 3, "Keep bundles plus the applied one should be kept")
+	assert.Equal(s.T(), fourth.Digest, entries[0].Digest, "most recent bundle should be first")
+
+	appliedEntry, err := s.cache.Get(applied.Digest)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), appliedEntry.Applied)
+
+	_, err = os.Stat(s.cache.Path(applied.Digest))
+	assert.Nil(s.T(), err, "applied bundle should never be pruned")
+}
+
+func (s *BundleCacheTestSuite) TestGetByPrefix() {
+	entry := s.add(testText, "mirror")
+
+	found, err := s.cache.Get(entry.Digest[:8])
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), entry.Digest, found.Digest)
+
+	found, err = s.cache.Get("sha256:" + entry.Digest)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), entry.Digest, found.Digest)
+
+	_, err = s.cache.Get("0000")
+	assert.NotNil(s.T(), err)
+
+	_, err = s.cache.Get("")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *BundleCacheTestSuite) TestAppliedWithEmptyCache() {
+	applied, err := s.cache.Applied()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", applied)
+
+	appliedAt, err := s.cache.AppliedAt()
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), appliedAt.IsZero())
+
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), entries)
+}
+
+func (s *BundleCacheTestSuite) TestAppliedAtIsUpdatedOnEveryRun() {
+	entry := s.add([]byte("first"), "mirror")
+	assert.Nil(s.T(), s.cache.MarkApplied(entry.Digest))
+
+	appliedFile := filepath.Join(s.cache.Dir, bundleCacheAppliedFile)
+	past := time.Now().Add(-48 * time.Hour)
+	assert.Nil(s.T(), os.Chtimes(appliedFile, past, past))
+
+	appliedAt, err := s.cache.AppliedAt()
+	assert.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), past, appliedAt, time.Second)
+
+	// Applying the same tarball again counts as a new run
+	assert.Nil(s.T(), s.cache.MarkApplied(entry.Digest))
+	appliedAt, err = s.cache.AppliedAt()
+	assert.Nil(s.T(), err)
+	assert.WithinDuration(s.T(), time.Now(), appliedAt, time.Minute)
+}
+
+func (s *BundleCacheTestSuite) TestBundlePin() {
+	pinned, err := s.cache.Pinned()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", pinned)
+
+	entry := s.add(testText, "mirror")
+	assert.Nil(s.T(), s.cache.SavePin(entry.Digest))
+
+	// A new cache on the same dir, as after a restart
+	restarted := bundleCache{Dir: s.cache.Dir, Keep: s.cache.Keep}
+	pinned, err = restarted.Pinned()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), entry.Digest, pinned)
+
+	entries, err := restarted.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 1, "the pin should not be listed as a bundle")
+
+	assert.Nil(s.T(), restarted.SavePin(""))
+	pinned, err = s.cache.Pinned()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", pinned)
+	assert.Nil(s.T(), restarted.SavePin(""), "unpinning twice is not an error")
+}
+
+func (s *BundleCacheTestSuite) TestS3Pin() {
+	pin, err := s.cache.S3Pin()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s3Pin{}, pin)
+
+	assert.Nil(s.T(), s.cache.SaveS3Pin(s3Pin{Version: "version-1", Source: "primary"}))
+	pin, err = s.cache.S3Pin()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s3Pin{Version: "version-1", Source: "primary"}, pin)
+
+	assert.Nil(s.T(), s.cache.SaveS3Pin(s3Pin{}))
+	pin, err = s.cache.S3Pin()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s3Pin{}, pin)
+}
+
+func (s *BundleCacheTestSuite) TestS3PinIsNotABundle() {
+	assert.Nil(s.T(), s.cache.SaveS3Pin(s3Pin{Version: "version-1", Source: "primary"}))
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), entries)
+
+	// Pruning must not trip over the pin either
+	s.add([]byte("first"), "mirror")
+	s.add([]byte("second"), "mirror")
+	s.add([]byte("third"), "mirror")
+	assert.Nil(s.T(), s.cache.prune())
+	entries, err = s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 2)
+
+	pin, err := s.cache.S3Pin()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "version-1", pin.Version)
+}
+
+func (s *BundleCacheTestSuite) TestListSkipsForeignMetadata() {
+	entry := s.add(testText, "mirror")
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.cache.Dir, "other.json"), []byte(`{"source": "s3"}`), 0600))
+
+	entries, err := s.cache.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 1)
+	assert.Equal(s.T(), entry.Digest, entries[0].Digest)
+}
@@ -0,0 +1,159 @@
+// Functions for calculating and parsing file digests
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Algorithm assumed when none is configured and none can be inferred from the checksum URL
+const defaultChecksumAlgorithm = "md5"
+
+// Supported digest algorithms, keyed by the name used in config and in checksum file suffixes
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Matches BSD-style checksum lines, e.g. "SHA256 (file.tgz) = <digest>"
+var bsdChecksumLine = regexp.MustCompile(`^[A-Za-z0-9-]+ \(.*\) = ([0-9A-Fa-f]+)$`)
+
+// checksumAlgorithmNames returns the sorted names of all supported digest algorithms
+func checksumAlgorithmNames() []string {
+	names := make([]string, 0, len(checksumAlgorithms))
+	for name := range checksumAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// checksumAlgorithmFromURL infers the digest algorithm from the suffix of a checksum URL
+// such as "${url}.sha256". An empty string is returned if the suffix is not recognized.
+func checksumAlgorithmFromURL(checksumURL string) string {
+	lowerURL := strings.ToLower(checksumURL)
+	for _, name := range checksumAlgorithmNames() {
+		if strings.HasSuffix(lowerURL, "."+name) || strings.HasSuffix(lowerURL, "."+name+"sum") {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// resolveChecksumAlgorithm picks the digest algorithm to use for a download.
+//
+// An explicitly configured algorithm wins, then one inferred from the checksum URL, then MD5
+// for backwards compatibility.
+func resolveChecksumAlgorithm(configured, checksumURL string) (string, error) {
+	algorithm := strings.ToLower(configured)
+	if algorithm == "" {
+		algorithm = checksumAlgorithmFromURL(checksumURL)
+	}
+	if algorithm == "" {
+		algorithm = defaultChecksumAlgorithm
+	}
+
+	if _, ok := checksumAlgorithms[algorithm]; !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm '%s', choose one of: %s", configured, strings.Join(checksumAlgorithmNames(), ", "))
+	}
+
+	return algorithm, nil
+}
+
+// Calculates the digest of a local file with the given algorithm
+func fileChecksum(path, algorithm string) (string, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm '%s'", algorithm)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := newHash()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func validateChecksum(path, algorithm, checksum string) error {
+	newChecksum, err := fileChecksum(path, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if newChecksum != checksum {
+		logrus.Debugf("Checksums for downloaded file do not match: '%s' != '%s'", newChecksum, checksum)
+		return errors.New("checksum does not match expected value")
+	}
+
+	return nil
+}
+
+// ensureChecksumLength makes sure that a remote checksum could have been produced by the algorithm,
+// so that a misconfigured algorithm is reported as such instead of as a checksum mismatch.
+func ensureChecksumLength(checksum, algorithm string) error {
+	expected := checksumAlgorithms[algorithm]().Size() * 2
+	if len(checksum) != expected {
+		return fmt.Errorf("remote checksum has %d hex characters, but %s needs %d", len(checksum), algorithm, expected)
+	}
+
+	return nil
+}
+
+// parseChecksumFile extracts the hex digest from the contents of a remote checksum file.
+//
+// Accepted formats are a bare hex digest, coreutils-style "<digest>  <filename>" lines
+// (as written by md5sum, sha256sum, etc.) and BSD-style "SHA256 (<filename>) = <digest>" lines.
+// Only the first non-empty, non-comment line is considered.
+func parseChecksumFile(content []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		digest := strings.Fields(line)[0]
+		if matches := bsdChecksumLine.FindStringSubmatch(line); matches != nil {
+			digest = matches[1]
+		}
+		// coreutils escapes filenames containing backslashes or newlines with a leading '\'
+		digest = strings.TrimPrefix(digest, "\\")
+
+		if _, err := hex.DecodeString(digest); err != nil {
+			return "", fmt.Errorf("checksum '%s' is not a hex digest", digest)
+		}
+
+		return strings.ToLower(digest), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "unable to read checksum")
+	}
+
+	return "", nil
+}
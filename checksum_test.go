@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	digest := "f6c1706ecdb494224b49d863788e3724b19275df13afbd676f34b3d6f9bdbe37"
+
+	for _, content := range []string{
+		digest,
+		digest + "\n",
+		"  " + digest + "  \n",
+		digest + "  testfile.txt\n",
+		digest + " *testfile.txt\n",
+		"# comment\n\n" + digest + "  testfile.txt\n",
+		"SHA256 (testfile.txt) = " + digest + "\n",
+		"F6C1706ECDB494224B49D863788E3724B19275DF13AFBD676F34B3D6F9BDBE37  testfile.txt",
+	} {
+		parsed, err := parseChecksumFile([]byte(content))
+		assert.Nil(t, err, "content: %q", content)
+		assert.Equal(t, digest, parsed, "content: %q", content)
+	}
+
+	parsed, err := parseChecksumFile([]byte(""))
+	assert.Nil(t, err)
+	assert.Equal(t, "", parsed)
+
+	_, err = parseChecksumFile([]byte("<html>Not Found</html>"))
+	assert.NotNil(t, err)
+}
+
+func TestResolveChecksumAlgorithm(t *testing.T) {
+	cases := []struct {
+		configured  string
+		checksumURL string
+		expected    string
+	}{
+		{"", "", "md5"},
+		{"", "https://example.com/file.tgz.md5", "md5"},
+		{"", "https://example.com/file.tgz.sha256", "sha256"},
+		{"", "https://example.com/file.tgz.SHA512", "sha512"},
+		{"", "https://example.com/file.tgz.sha256sum", "sha256"},
+		{"", "https://example.com/checksum", "md5"},
+		{"SHA256", "https://example.com/file.tgz.md5", "sha256"},
+	}
+
+	for _, c := range cases {
+		algorithm, err := resolveChecksumAlgorithm(c.configured, c.checksumURL)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, algorithm, "configured: %q, url: %q", c.configured, c.checksumURL)
+	}
+
+	_, err := resolveChecksumAlgorithm("crc32", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,168 @@
+// Helper methods for pulling the Ansible repository from a git remote
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Matches a full (SHA-1 or SHA-256) commit id, which is used as a pinned ref as-is
+var gitCommitRegex = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// gitDownloader pulls a ref of a git remote into a local bare repository and archives it as a tarball,
+// so that the rest of the pipeline can treat it like any other source.
+//
+// Commits are identified by their SHA, which is used for idempotency instead of a checksum file.
+type gitDownloader struct {
+	downloader
+	ref      string // branch, tag or full commit SHA to deploy
+	cacheDir string // path to the bare repository used as a cache of the remote
+}
+
+// git runs a git command against the cache repository and returns its stdout.
+func (downloader gitDownloader) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", downloader.cacheDir}, args...)...)
+	// Never wait for credentials on a terminal, the daemon has none
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logrus.Debugln("Running git command: ", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		failedCommandLogger(cmd)
+		return "", errors.Wrapf(err, "git %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// ensureCache creates the bare cache repository if it does not exist yet.
+func (downloader gitDownloader) ensureCache() error {
+	if _, err := os.Stat(downloader.cacheDir); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(downloader.cacheDir, 0700); err != nil {
+		return errors.Wrap(err, "unable to create git cache dir")
+	}
+
+	_, err := downloader.git("init", "--bare", "--quiet")
+	return err
+}
+
+// RemoteVersion resolves the configured ref to a commit SHA on the remote.
+func (downloader gitDownloader) RemoteVersion(remotePath string) (string, error) {
+	if gitCommitRegex.MatchString(downloader.ref) {
+		return downloader.ref, nil
+	}
+
+	if err := downloader.ensureCache(); err != nil {
+		return "", err
+	}
+
+	out, err := downloader.git("ls-remote", remotePath)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to list remote refs")
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	// Peeled tags come first so that annotated tags resolve to their commit rather than the tag object
+	candidates := []string{
+		downloader.ref,
+		"refs/heads/" + downloader.ref,
+		"refs/tags/" + downloader.ref + "^{}",
+		"refs/tags/" + downloader.ref,
+	}
+	for _, candidate := range candidates {
+		if sha, ok := refs[candidate]; ok {
+			return sha, nil
+		}
+	}
+
+	return "", fmt.Errorf("ref '%s' not found on git remote %s", downloader.ref, remotePath)
+}
+
+// fetchCommit makes sure that the commit is present in the cache repository.
+func (downloader gitDownloader) fetchCommit(remotePath, commit string) error {
+	if err := downloader.ensureCache(); err != nil {
+		return err
+	}
+
+	if _, err := downloader.git("cat-file", "-e", commit+"^{commit}"); err == nil {
+		logrus.Debugf("Commit %s already present in git cache", commit)
+		return nil
+	}
+
+	_, err := downloader.git("fetch", "--quiet", "--force", "--tags", remotePath, "+refs/heads/*:refs/heads/*")
+	if err != nil {
+		return errors.Wrap(err, "unable to fetch from git remote")
+	}
+
+	if _, err := downloader.git("cat-file", "-e", commit+"^{commit}"); err == nil {
+		return nil
+	}
+
+	// Pinned commits that are not reachable from a branch or tag have to be asked for explicitly
+	if _, err := downloader.git("fetch", "--quiet", remotePath, commit); err != nil {
+		return errors.Wrapf(err, "unable to fetch commit %s", commit)
+	}
+
+	return nil
+}
+
+// DownloadVersion writes a gzipped tarball of the given commit to outputPath.
+func (downloader gitDownloader) DownloadVersion(remotePath, version, outputPath string) error {
+	if err := downloader.fetchCommit(remotePath, version); err != nil {
+		return err
+	}
+
+	// A failed git archive must not leave a truncated tarball at outputPath
+	return writeAtomic(outputPath, 0644, func(outFile *os.File) error {
+		gzipWriter := gzip.NewWriter(outFile)
+
+		cmd := exec.Command("git", "--git-dir", downloader.cacheDir, "archive", "--format=tar", version)
+		var stderr bytes.Buffer
+		cmd.Stdout = gzipWriter
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			failedCommandLogger(cmd)
+			return errors.Wrapf(err, "unable to archive commit %s: %s", version, strings.TrimSpace(stderr.String()))
+		}
+
+		return gzipWriter.Close()
+	})
+}
+
+// Download writes a gzipped tarball of the configured ref to outputPath.
+func (downloader gitDownloader) Download(remotePath, outputPath string) error {
+	version, err := downloader.RemoteVersion(remotePath)
+	if err != nil {
+		return err
+	}
+
+	return downloader.DownloadVersion(remotePath, version, outputPath)
+}
+
+// RemoteChecksum always returns an empty checksum, git sources are versioned by commit instead.
+func (downloader gitDownloader) RemoteChecksum(checksumURL string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestGitDownloaderTestSuite(t *testing.T) {
+	suite.Run(t, new(GitDownloaderTestSuite))
+}
+
+type GitDownloaderTestSuite struct {
+	suite.Suite
+	tmpDir   string
+	workDir  string
+	bareRepo string
+}
+
+// runGit runs a git command in the suite's work tree and returns its trimmed stdout
+func (s *GitDownloaderTestSuite) runGit(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.workDir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	assert.Nil(s.T(), err, string(out))
+
+	return strings.TrimSpace(string(out))
+}
+
+// commitFile commits a file to the work tree, pushes it to the bare repo and returns the commit SHA
+func (s *GitDownloaderTestSuite) commitFile(name, content string) string {
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.workDir, name), []byte(content), 0644))
+	s.runGit("add", name)
+	s.runGit("commit", "--quiet", "-m", "add "+name)
+	s.runGit("push", "--quiet", s.bareRepo, "main")
+
+	return s.runGit("rev-parse", "HEAD")
+}
+
+func (s *GitDownloaderTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.workDir = filepath.Join(s.tmpDir, "work")
+	s.bareRepo = filepath.Join(s.tmpDir, "remote.git")
+	assert.Nil(s.T(), os.Mkdir(s.workDir, 0755))
+
+	s.runGit("init", "--quiet", "--bare", s.bareRepo)
+	s.runGit("init", "--quiet", "--initial-branch", "main")
+}
+
+func (s *GitDownloaderTestSuite) TearDownTest() {
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *GitDownloaderTestSuite) newDownloader(ref string) gitDownloader {
+	return gitDownloader{
+		ref:      ref,
+		cacheDir: filepath.Join(s.tmpDir, "cache.git"),
+	}
+}
+
+func (s *GitDownloaderTestSuite) TestRemoteVersion() {
+	first := s.commitFile("foo.txt", "foo")
+	s.runGit("tag", "-a", "-m", "release", "v1")
+	second := s.commitFile("bar.txt", "bar")
+
+	version, err := s.newDownloader("main").RemoteVersion(s.bareRepo)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), second, version, "branch should resolve to its latest commit")
+
+	s.runGit("push", "--quiet", s.bareRepo, "v1")
+	version, err = s.newDownloader("v1").RemoteVersion(s.bareRepo)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), first, version, "annotated tag should resolve to its commit")
+
+	version, err = s.newDownloader(first).RemoteVersion(s.bareRepo)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), first, version, "pinned commit should be used as-is")
+
+	_, err = s.newDownloader("does-not-exist").RemoteVersion(s.bareRepo)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *GitDownloaderTestSuite) TestIdempotentDownload() {
+	first := s.commitFile("foo.txt", "foo")
+	downloader := s.newDownloader("main")
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+
+	version, err := idempotentVersionedDownload(downloader, s.bareRepo, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), first, version)
+
+	runDir := filepath.Join(s.tmpDir, "run1")
+	assert.Nil(s.T(), extractArchive(localFile, runDir, extractLimits{}))
+	text, err := ioutil.ReadFile(filepath.Join(runDir, "foo.txt"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "foo", string(text))
+
+	finfo, err := os.Stat(localFile)
+	assert.Nil(s.T(), err)
+
+	// Unchanged remote, nothing should be downloaded
+	version, err = idempotentVersionedDownload(downloader, s.bareRepo, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), first, version)
+
+	newFinfo, err := os.Stat(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), finfo.ModTime(), newFinfo.ModTime(), "modification time should not change")
+
+	// New commit on the branch
+	second := s.commitFile("bar.txt", "bar")
+	version, err = idempotentVersionedDownload(downloader, s.bareRepo, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), second, version)
+
+	runDir = filepath.Join(s.tmpDir, "run2")
+	assert.Nil(s.T(), extractArchive(localFile, runDir, extractLimits{}))
+	_, err = os.Stat(filepath.Join(runDir, "bar.txt"))
+	assert.Nil(s.T(), err, "new commit should be extracted")
+}
+
+func (s *GitDownloaderTestSuite) TestPinnedCommit() {
+	first := s.commitFile("foo.txt", "foo")
+	s.commitFile("bar.txt", "bar")
+
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	version, err := idempotentVersionedDownload(s.newDownloader(first), s.bareRepo, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), first, version)
+
+	runDir := filepath.Join(s.tmpDir, "run")
+	assert.Nil(s.T(), extractArchive(localFile, runDir, extractLimits{}))
+	_, err = os.Stat(filepath.Join(runDir, "bar.txt"))
+	assert.True(s.T(), os.IsNotExist(err), "later commits should not be extracted")
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -20,6 +21,12 @@ const (
 	httpPathAnsibleEnable       = "/ansible/enable"
 	httpPathAnsibleControl      = "/ansible/control"
 	httpPathStatus              = "/ansible/status"
+	httpPathBundles             = "/ansible/bundles"
+	httpPathBundlesPin          = "/ansible/bundles/pin"
+	httpPathBundlesUnpin        = "/ansible/bundles/unpin"
+	httpPathS3Versions          = "/ansible/s3/versions"
+	httpPathS3Pin               = "/ansible/s3/pin"
+	httpPathS3Unpin             = "/ansible/s3/unpin"
 )
 
 var (
@@ -62,6 +69,151 @@ func HandlerAnsibleDisable(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
 }
 
+// MakeBundlePinHandler returns an http handler that pins runs to a cached bundle and calls runOnce.
+func MakeBundlePinHandler(runOnce func()) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		entry, err := newBundleCache().Get(r.Form.Get("digest"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := newBundleCache().SavePin(entry.Digest); err != nil {
+			http.Error(w, "unable to record pin: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pinnedBundle = entry.Digest
+		logrus.Infoln("Pinned bundle ", entry.Digest)
+		runOnce()
+		http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
+	}
+}
+
+func HandlerBundleUnpin(w http.ResponseWriter, r *http.Request) {
+	if err := newBundleCache().SavePin(""); err != nil {
+		http.Error(w, "unable to remove pin: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pinnedBundle = ""
+	logrus.Infoln("Unpinned bundle")
+	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
+}
+
+func HandlerBundles(w http.ResponseWriter, r *http.Request) {
+	entries, err := newBundleCache().List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// HandlerS3Versions lists the versions of the object of an S3 source, chosen by its name with the 'source' parameter
+func HandlerS3Versions(w http.ResponseWriter, r *http.Request) {
+	sources, err := loadSources()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	source, err := findS3Source(sources, r.URL.Query().Get("source"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Listing versions works regardless of whether the source is configured as versioned
+	source.S3Versioned = true
+	client, remotePath, err := source.newDownloader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	versions, err := client.(s3VersionedDownloader).Versions(remotePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// MakeS3PinHandler pins the S3 object version given by the 'version' parameter, for the S3 source named
+// by the 'source' parameter or all S3 sources, then triggers a run.
+func MakeS3PinHandler(runOnce func()) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		version := r.Form.Get("version")
+		if version == "" {
+			http.Error(w, "no version given", http.StatusBadRequest)
+			return
+		}
+
+		sources, err := loadSources()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := pinS3Version(sources, r.Form.Get("source"), version); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		pin := s3Pin{Version: version, Source: r.Form.Get("source")}
+		if err := newBundleCache().SaveS3Pin(pin); err != nil {
+			http.Error(w, "unable to record pin: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pinnedS3Version = pin.Version
+		pinnedS3VersionSource = pin.Source
+		logrus.Infoln("Pinned S3 object version ", version)
+		runOnce()
+		http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
+	}
+}
+
+func HandlerS3Unpin(w http.ResponseWriter, r *http.Request) {
+	if err := newBundleCache().SaveS3Pin(s3Pin{}); err != nil {
+		http.Error(w, "unable to remove pin: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pinnedS3Version = ""
+	pinnedS3VersionSource = ""
+	logrus.Infoln("Unpinned S3 object version")
+	http.Redirect(w, r, httpPathAnsibleControl, http.StatusFound)
+}
+
 func HandlerAnsibleControl(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		AnsibleDisabled       bool
@@ -69,12 +221,16 @@ func HandlerAnsibleControl(w http.ResponseWriter, r *http.Request) {
 		JobRunning            bool
 		Hostname              string
 		DisableReason         string
+		PinnedBundle          string
+		PinnedS3Version       string
 	}{
 		ansibleDisabled, // Callout to the global var in main... inelegant
 		ansibleLastRunSuccess,
 		ansibleRunning,
 		hostname,
 		disableReason,
+		pinnedBundle,
+		pinnedS3Version,
 	}
 
 	t, _ := template.New("foo").Parse(ansibleController)
@@ -99,6 +255,12 @@ func HandlerStatus(w http.ResponseWriter, r *http.Request) {
 		"ansible_disabled":         ansibleDisabled,
 		"ansible_running":          ansibleRunning,
 		"ansible_last_run_success": ansibleLastRunSuccess,
+		"ansible_version":          ansibleVersion,
+		"source":                   sourceName,
+		"source_version":           sourceVersion,
+		"bundle":                   sourceBundle,
+		"pinned_bundle":            pinnedBundle,
+		"pinned_s3_version":        pinnedS3Version,
 		"version":                  Version,
 	}
 
@@ -125,6 +287,12 @@ func NewServer(runOnce func()) *http.Server {
 	r.HandleFunc(httpPathAnsibleEnable, HandlerAnsibleEnable).Methods("POST")
 	r.HandleFunc(httpPathAnsibleControl, HandlerAnsibleControl).Methods("GET")
 	r.HandleFunc(httpPathStatus, HandlerStatus).Methods("GET")
+	r.HandleFunc(httpPathBundles, HandlerBundles).Methods("GET")
+	r.HandleFunc(httpPathBundlesPin, MakeBundlePinHandler(runOnce)).Methods("POST")
+	r.HandleFunc(httpPathBundlesUnpin, HandlerBundleUnpin).Methods("POST")
+	r.HandleFunc(httpPathS3Versions, HandlerS3Versions).Methods("GET")
+	r.HandleFunc(httpPathS3Pin, MakeS3PinHandler(runOnce)).Methods("POST")
+	r.HandleFunc(httpPathS3Unpin, HandlerS3Unpin).Methods("POST")
 
 	srv := &http.Server{
 		Handler:      r,
@@ -3,85 +3,526 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultHTTPConnectTimeout = 10 * time.Second
+	defaultHTTPHeaderTimeout  = 30 * time.Second
+	defaultHTTPIdleTimeout    = 60 * time.Second
+	defaultHTTPRetryBackoff   = 1 * time.Second
+	maxHTTPRetryBackoff       = 5 * time.Minute
+)
+
 type httpDownloader struct {
 	downloader
 	username string
-	password string
+	auth     httpAuth
+
+	connectTimeout time.Duration // Time allowed to establish the connection, including the TLS handshake
+	headerTimeout  time.Duration // Time allowed for the response headers to arrive once the request is sent
+	idleTimeout    time.Duration // Time allowed without receiving any data while reading the response body
+	retries        int           // Number of times a failed download is retried
+	retryBackoff   time.Duration // Wait before the first retry, doubled on every further retry
+	tls            httpTLSConfig
+	httpClient     *http.Client // Shared by all requests, so that connections are reused. Built per request if nil.
 }
 
-func (downloader httpDownloader) Download(remotePath, outputPath string) error {
-	outFile, err := os.Create(outputPath)
+// httpAuth holds the credentials for the HTTP source that are read again for every request
+type httpAuth struct {
+	Password secret            // Basic auth password
+	Token    secret            // Bearer token, used instead of basic auth if set
+	Headers  map[string]secret // Additional headers, e.g. X-JFrog-Art-Api
+}
+
+// authenticate adds the credentials to the request, reading secrets from their files or environment variables
+func (downloader httpDownloader) authenticate(req *http.Request) error {
+	for name, header := range downloader.auth.Headers {
+		value, err := header.Get()
+		if err != nil {
+			return errors.Wrapf(err, "unable to get header %s", name)
+		}
+		req.Header.Set(name, value)
+	}
+
+	if downloader.auth.Token.isSet() {
+		token, err := downloader.auth.Token.Get()
+		if err != nil {
+			return errors.Wrap(err, "unable to get bearer token")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	password, err := downloader.auth.Password.Get()
+	if err != nil {
+		return errors.Wrap(err, "unable to get password")
+	}
+	if downloader.username != "" && password != "" {
+		req.SetBasicAuth(downloader.username, password)
+	}
+
+	return nil
+}
+
+// httpCacheValidators are the validators of the response that was last written to a local file.
+// They are used to make conditional requests, so that an unchanged remote file is not downloaded again.
+type httpCacheValidators struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`     // Size of the local file when it was written
+	ModTime      time.Time `json:"mod_time"` // Modification time of the local file when it was written
+}
+
+func httpCacheValidatorsPath(outputPath string) string {
+	return outputPath + ".http.json"
+}
 
+// readCacheValidators returns the validators for the local file, if it still holds the response for remotePath.
+func readCacheValidators(remotePath, outputPath string) *httpCacheValidators {
+	data, err := ioutil.ReadFile(httpCacheValidatorsPath(outputPath))
+	if err != nil {
+		return nil
+	}
+
+	var validators httpCacheValidators
+	if err := json.Unmarshal(data, &validators); err != nil {
+		logrus.Debugf("Ignoring unreadable HTTP cache validators: %v", err)
+		return nil
+	}
+
+	// A file that was modified since it was downloaded must be downloaded again
+	finfo, err := os.Stat(outputPath)
+	if err != nil || validators.URL != remotePath || finfo.Size() != validators.Size || !finfo.ModTime().Equal(validators.ModTime) {
+		return nil
+	}
+
+	return &validators
+}
+
+// writeCacheValidators records the validators of the response that was just written to the local file.
+func writeCacheValidators(remotePath, outputPath string, header http.Header) error {
+	validators := httpCacheValidators{
+		URL:          remotePath,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	if validators.ETag == "" && validators.LastModified == "" {
+		return nil
+	}
+
+	finfo, err := os.Stat(outputPath)
 	if err != nil {
 		return err
 	}
+	validators.Size = finfo.Size()
+	validators.ModTime = finfo.ModTime()
+
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(httpCacheValidatorsPath(outputPath), data, 0600)
+}
+
+// httpPartialPath is where an in-progress download of outputPath is kept, so that it can be resumed
+func httpPartialPath(outputPath string) string {
+	return outputPath + ".part"
+}
+
+// readPartialValidators returns the validators of the response that the partial download of
+// outputPath came from, if the download can be resumed with a range request.
+func readPartialValidators(remotePath, outputPath string) (*httpCacheValidators, int64) {
+	partialPath := httpPartialPath(outputPath)
+	data, err := ioutil.ReadFile(httpCacheValidatorsPath(partialPath))
+	if err != nil {
+		return nil, 0
+	}
+
+	var validators httpCacheValidators
+	if err := json.Unmarshal(data, &validators); err != nil || validators.URL != remotePath {
+		return nil, 0
+	}
+
+	finfo, err := os.Stat(partialPath)
+	if err != nil || finfo.Size() == 0 {
+		return nil, 0
+	}
+
+	return &validators, finfo.Size()
+}
+
+// writePartialValidators records the validators of a response that is about to be written to the partial file.
+// Only strong validators allow resuming a download, without them any previous validators are removed.
+func writePartialValidators(remotePath, outputPath string, header http.Header) error {
+	validatorsPath := httpCacheValidatorsPath(httpPartialPath(outputPath))
+
+	validators := httpCacheValidators{
+		URL:          remotePath,
+		LastModified: header.Get("Last-Modified"),
+	}
+	if etag := header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		validators.ETag = etag
+	}
+	if validators.ETag == "" && validators.LastModified == "" {
+		if err := os.Remove(validatorsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(validatorsPath, data, 0600)
+}
+
+// removePartial discards the partial download of outputPath
+func removePartial(outputPath string) {
+	partialPath := httpPartialPath(outputPath)
+	for _, path := range []string{partialPath, httpCacheValidatorsPath(partialPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove partial download: %v", err)
+		}
+	}
+}
+
+// retryableError marks download failures that may succeed when tried again, such as network errors and 5xx responses
+type retryableError struct {
+	error
+}
+
+func (err retryableError) Unwrap() error {
+	return err.error
+}
+
+// withClient returns the downloader with an HTTP client that all of its requests share
+func (downloader httpDownloader) withClient() (httpDownloader, error) {
+	client, err := downloader.newClient()
+	if err != nil {
+		return downloader, err
+	}
+	downloader.httpClient = client
+
+	return downloader, nil
+}
+
+// client returns the shared HTTP client, or a new one if the downloader has none
+func (downloader httpDownloader) client() (*http.Client, error) {
+	if downloader.httpClient != nil {
+		return downloader.httpClient, nil
+	}
+
+	return downloader.newClient()
+}
+
+// newClient returns an HTTP client with the configured TLS settings and connect and response header timeouts
+func (downloader httpDownloader) newClient() (*http.Client, error) {
+	tlsConfig, err := downloader.tls.load()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TLS config")
+	}
+
+	connectTimeout := durationOrDefault(downloader.connectTimeout, defaultHTTPConnectTimeout)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = durationOrDefault(downloader.headerTimeout, defaultHTTPHeaderTimeout)
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, CheckRedirect: downloader.checkRedirect}, nil
+}
+
+// checkRedirect drops the credentials from redirects to another host, such as a CDN or pre-signed storage URL.
+// The client only drops the Authorization header by itself, not the configured custom headers.
+func (downloader httpDownloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+		for name := range downloader.auth.Headers {
+			req.Header.Del(name)
+		}
+	}
 
-	client := http.Client{
-		Timeout: 15 * time.Second,
+	return nil
+}
+
+// backoff returns how long to wait before the given retry: exponential in the number of attempts,
+// with up to 50% jitter either way so that many hosts do not hammer a recovering server in lockstep.
+func (downloader httpDownloader) backoff(attempt int) time.Duration {
+	backoff := durationOrDefault(downloader.retryBackoff, defaultHTTPRetryBackoff) << uint(attempt)
+	if backoff <= 0 || backoff > maxHTTPRetryBackoff {
+		backoff = maxHTTPRetryBackoff
 	}
 
-	req, err := http.NewRequest("GET", remotePath, nil)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// Download fetches remotePath into outputPath.
+//
+// If outputPath holds a previous response for remotePath that came with an ETag or Last-Modified header,
+// a conditional request is made and a 304 response leaves the file untouched.
+//
+// Failed attempts are retried with exponential backoff. The response is written to a partial file next to
+// outputPath, and an interrupted download resumes from where it stopped with a range request.
+func (downloader httpDownloader) Download(remotePath, outputPath string) error {
+	for attempt := 0; ; attempt++ {
+		err := downloader.download(remotePath, outputPath)
+		if err == nil {
+			return nil
+		}
+
+		var retryable retryableError
+		if !errors.As(err, &retryable) || attempt >= downloader.retries {
+			return err
+		}
+
+		backoff := downloader.backoff(attempt)
+		logrus.Warnf("Download attempt %d of %s failed, retrying in %s: %v", attempt+1, remotePath, backoff, err)
+		promHTTPDownloadRetries.Inc()
+		time.Sleep(backoff)
+	}
+}
+
+// download makes a single attempt at fetching remotePath into outputPath
+func (downloader httpDownloader) download(remotePath, outputPath string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", remotePath, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to create request")
 	}
 
-	if downloader.username != "" && downloader.password != "" {
-		req.SetBasicAuth(downloader.username, downloader.password)
+	if err := downloader.authenticate(req); err != nil {
+		return err
 	}
-	resp, err := client.Do(req)
+
+	partial, offset := readPartialValidators(remotePath, outputPath)
+	if partial != nil {
+		// If-Range makes the server send the whole file instead, should it have changed in the meantime
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if partial.ETag != "" {
+			req.Header.Set("If-Range", partial.ETag)
+		} else {
+			req.Header.Set("If-Range", partial.LastModified)
+		}
+	} else if validators := readCacheValidators(remotePath, outputPath); validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	client, err := downloader.client()
 	if err != nil {
 		return err
 	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
 	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		logrus.Infof("Remote file not modified, keeping %s", outputPath)
+		return nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file does not fit the remote file, start over
+		removePartial(outputPath)
+		return retryableError{fmt.Errorf("bad status code: %v", resp.StatusCode)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableError{fmt.Errorf("bad status code: %v", resp.StatusCode)}
+	case resp.StatusCode >= 400:
 		return fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
 
+	flags := os.O_CREATE | os.O_WRONLY
+	if resp.StatusCode == http.StatusPartialContent {
+		// Only a range that continues the partial file can be appended to it, anything else would corrupt the file
+		contentRange := resp.Header.Get("Content-Range")
+		if partial == nil || !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			removePartial(outputPath)
+			return retryableError{fmt.Errorf("unexpected content range '%s' when resuming at byte %d", contentRange, offset)}
+		}
+		logrus.Infof("Resuming download of %s at byte %d", remotePath, offset)
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+		if err := writePartialValidators(remotePath, outputPath, resp.Header); err != nil {
+			return err
+		}
+	}
+
+	partialFile, err := os.OpenFile(httpPartialPath(outputPath), flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Give up on the attempt when the server stops sending data
+	idleTimeout := durationOrDefault(downloader.idleTimeout, defaultHTTPIdleTimeout)
+	idleTimer := time.AfterFunc(idleTimeout, cancel)
+	defer idleTimer.Stop()
+
 	// Persist to file in 32K chunks, instead of slurping
-	_, err = io.Copy(outFile, resp.Body)
+	_, err = io.Copy(partialFile, idleTimeoutReader{resp.Body, idleTimer, idleTimeout})
+	if closeErr := partialFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no data received for %s", idleTimeout)
+		}
+		return retryableError{errors.Wrap(err, "download interrupted")}
+	}
+
+	// The validators must never describe a partially written file
+	if err := os.Remove(httpCacheValidatorsPath(outputPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(httpPartialPath(outputPath), outputPath); err != nil {
 		return err
 	}
-	if err := outFile.Close(); err != nil {
-		logrus.Errorf("Failed to close file: %v", err)
+	removePartial(outputPath)
+
+	if err := writeCacheValidators(remotePath, outputPath, resp.Header); err != nil {
+		logrus.Warnf("Failed to record HTTP cache validators: %v", err)
 	}
 
 	return nil
 }
 
+// Open starts downloading remotePath and returns the response body, for extracting it while it is downloaded.
+//
+// Unlike Download, failed requests are not retried and interrupted streams are not resumed,
+// as the reader may already have consumed part of the stream.
+func (downloader httpDownloader) Open(remotePath string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", remotePath, nil)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	if err := downloader.authenticate(req); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	client, err := downloader.client()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("bad status code: %v", resp.StatusCode)
+	}
+
+	// Give up on the stream when the server stops sending data
+	idleTimeout := durationOrDefault(downloader.idleTimeout, defaultHTTPIdleTimeout)
+	idleTimer := time.AfterFunc(idleTimeout, cancel)
+
+	return httpStream{idleTimeoutReader{resp.Body, idleTimer, idleTimeout}, resp.Body, cancel}, nil
+}
+
+// httpStream is the body of a streamed download
+type httpStream struct {
+	idleTimeoutReader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (s httpStream) Close() error {
+	s.timer.Stop()
+	defer s.cancel()
+	return s.body.Close()
+}
+
+// idleTimeoutReader pushes back the idle timer every time data is read
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func durationOrDefault(d, defaultDuration time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDuration
+	}
+	return d
+}
+
 func (downloader httpDownloader) RemoteChecksum(checksumURL string) (string, error) {
 
-	timeout := time.Duration(2 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+	client, err := downloader.client()
+	if err != nil {
+		return "", err
 	}
-	req, err := http.NewRequest("GET", checksumURL, nil)
+	// The client is shared with the download, so the timeout applies to this request only
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", checksumURL, nil)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to create request")
 	}
 
-	if downloader.username != "" && downloader.password != "" {
-		req.SetBasicAuth(downloader.username, downloader.password)
+	if err := downloader.authenticate(req); err != nil {
+		return "", err
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to get remote md5sum")
+		return "", errors.Wrap(err, "failed to get remote checksum")
 	}
 	// Ignore the checksum if it's not found, as assumed by the caller of this function.
 	if resp.StatusCode == http.StatusNotFound {
-		logrus.Debugf("MD5 sum not found at: %s", checksumURL)
+		logrus.Debugf("Checksum not found at: %s", checksumURL)
 		return "", nil
 	}
 	// A non-2xx status code does not cause an error, so we handle it here. https://pkg.go.dev/net/http#Client.Do
@@ -89,13 +530,13 @@ func (downloader httpDownloader) RemoteChecksum(checksumURL string) (string, err
 		return "", fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
 
-	logrus.Debugf("Found MD5 sum at: %s", checksumURL)
+	logrus.Debugf("Found checksum at: %s", checksumURL)
 	defer resp.Body.Close()
 	remoteChecksum, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logrus.Debug("Error reading remote checksum")
-		return "", errors.Wrap(err, "failed to read remote md5sum")
+		return "", errors.Wrap(err, "failed to read remote checksum")
 	}
 
-	return string(remoteChecksum), nil
+	return parseChecksumFile(remoteChecksum)
 }
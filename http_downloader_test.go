@@ -6,10 +6,13 @@ import (
 	"testing"
 	"time"
 
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 )
 
 var (
@@ -18,12 +21,32 @@ var (
 	testFilenameHash = "testfile.txt.md5"
 	testMD5          = "7b20fda6af27c1b59ebdd8c09a93e770"
 
+	testFilenameSha256Hash = "testfile.txt.sha256"
+	testSha256Sum          = "f6c1706ecdb494224b49d863788e3724b19275df13afbd676f34b3d6f9bdbe37  testfile.txt\n"
+
+	testDefaultChecksumAlgorithm = ""
+
   testEmptyChecksumUrl  = ""
   testChecksumUrlPath   = "custom.txt.md5"
 
 	testHashlessFilename = "nohash.txt"
 	testHashlessText     = []byte("Ut enim ad minim veniam, quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat.")
 
+	testETagFilename         = "etag.txt"
+	testLastModifiedFilename = "lastmodified.txt"
+	testLastModified         = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	testTokenFilename       = "token.txt"
+	testTokens              = []string{"token-1", "token-2"}
+	testHeaderFilename      = "header.txt"
+	testHeaderName          = "X-JFrog-Art-Api"
+	testHeaderValue         = "api-key"
+	testCorruptFilename     = "corrupt.txt"
+	testFlakyFilename       = "flaky.txt"
+	testInterruptedFilename = "interrupted.txt"
+	testStalledFilename     = "stalled.txt"
+	testWrongRangeFilename  = "wrongrange.txt"
+
 	testBasicAuthChecksum     = []byte("bb651e9638be48e76bbbe936b9651083")
 	testBasicAuthFilename     = "basicauth.txt"
 	testBasicAuthFilenameHash = "basicauth.txt.md5"
@@ -39,10 +62,17 @@ func TestHttpDownloaderTestSuite(t *testing.T) {
 
 type HttpDownloaderTestSuite struct {
 	suite.Suite
-	testServer *httptest.Server
+	testServer    *httptest.Server
+	fullResponses int // Number of responses with a body for the conditional request test files
+	requests      int // Number of requests for the retry test files
+	rangeRequests int // Number of range requests for the retry test files
+	token         string
 }
 
 func (s *HttpDownloaderTestSuite) SetupTest() {
+	s.fullResponses = 0
+	s.requests = 0
+	s.rangeRequests = 0
 	s.testServer = httptest.NewServer(
 		http.HandlerFunc(
 			func(rw http.ResponseWriter, req *http.Request) {
@@ -68,10 +98,83 @@ func (s *HttpDownloaderTestSuite) SetupTest() {
 					rw.Write(testText)
 				case "/" + testFilenameHash:
 					rw.Write([]byte(testMD5))
+				case "/" + testFilenameSha256Hash:
+					rw.Write([]byte(testSha256Sum))
         case "/" + testChecksumUrlPath:
 					rw.Write([]byte(testMD5))
 				case "/" + testHashlessFilename:
 					rw.Write(testHashlessText)
+				case "/" + testETagFilename:
+					rw.Header().Set("ETag", `"v1"`)
+					if req.Header.Get("If-None-Match") == `"v1"` {
+						rw.WriteHeader(http.StatusNotModified)
+						return
+					}
+					s.fullResponses++
+					rw.Write(testText)
+				case "/" + testLastModifiedFilename:
+					if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !testLastModified.After(since) {
+						rw.WriteHeader(http.StatusNotModified)
+						return
+					}
+					s.fullResponses++
+					rw.Header().Set("Last-Modified", testLastModified.Format(http.TimeFormat))
+					rw.Write(testText)
+				case "/" + testTokenFilename:
+					if req.Header.Get("Authorization") != "Bearer "+s.token {
+						rw.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					rw.Write(testText)
+				case "/" + testHeaderFilename:
+					if req.Header.Get(testHeaderName) != testHeaderValue {
+						rw.WriteHeader(http.StatusForbidden)
+						return
+					}
+					rw.Write(testText)
+				case "/" + testCorruptFilename:
+					rw.Write(testHashlessText)
+				case "/" + testCorruptFilename + ".md5":
+					rw.Write([]byte(testMD5))
+				case "/" + testFlakyFilename:
+					s.requests++
+					if s.requests < 3 {
+						rw.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					rw.Write(testText)
+				case "/" + testWrongRangeFilename:
+					s.requests++
+					rw.Header().Set("ETag", `"v1"`)
+					if req.Header.Get("Range") != "" {
+						// Answer the resumed request with the start of the file instead
+						s.rangeRequests++
+						rw.Header().Set("Content-Range", fmt.Sprintf("bytes 0-9/%d", len(testText)))
+						rw.WriteHeader(http.StatusPartialContent)
+						rw.Write(testText[:10])
+						return
+					}
+					if s.requests > 1 {
+						rw.Write(testText)
+						return
+					}
+					rw.Header().Set("Content-Length", strconv.Itoa(len(testText)))
+					rw.Write(testText[:len(testText)/2])
+				case "/" + testInterruptedFilename, "/" + testStalledFilename:
+					s.requests++
+					rw.Header().Set("ETag", `"v1"`)
+					if req.Header.Get("Range") != "" {
+						s.rangeRequests++
+						http.ServeContent(rw, req, "", testLastModified, bytes.NewReader(testText))
+						return
+					}
+					// Send the first half of the file, then drop the connection or stall
+					rw.Header().Set("Content-Length", strconv.Itoa(len(testText)))
+					rw.Write(testText[:len(testText)/2])
+					if req.URL.Path == "/"+testStalledFilename {
+						rw.(http.Flusher).Flush()
+						time.Sleep(200 * time.Millisecond)
+					}
 				default:
 					rw.WriteHeader(404)
 				}
@@ -83,12 +186,23 @@ func (s *HttpDownloaderTestSuite) TearDownTest() {
 	os.RemoveAll(testFilename)
 	os.RemoveAll(testHashlessFilename)
 	os.RemoveAll(testBasicAuthFilename)
+	os.RemoveAll(testETagFilename)
+	os.RemoveAll(httpCacheValidatorsPath(testETagFilename))
+	os.RemoveAll(testLastModifiedFilename)
+	os.RemoveAll(httpCacheValidatorsPath(testLastModifiedFilename))
+	os.RemoveAll(stagedDownloadPath(testFilename))
+	os.RemoveAll(testTokenFilename)
+	os.RemoveAll(testHeaderFilename)
+	for _, filename := range []string{testFlakyFilename, testInterruptedFilename, testStalledFilename, testWrongRangeFilename} {
+		os.RemoveAll(filename)
+		os.RemoveAll(httpCacheValidatorsPath(filename))
+		removePartial(filename)
+	}
 }
 
 func (s *HttpDownloaderTestSuite) TestDownloadFile() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
 	err := downloader.Download(s.testServer.URL+"/"+testFilename, testFilename)
 	assert.Nil(s.T(), err)
@@ -98,12 +212,132 @@ func (s *HttpDownloaderTestSuite) TestDownloadFile() {
 	assert.Equal(s.T(), text, testText)
 }
 
+func (s *HttpDownloaderTestSuite) TestConditionalDownloadETag() {
+	downloader := httpDownloader{}
+	for i := 0; i < 3; i++ {
+		err := downloader.Download(s.testServer.URL+"/"+testETagFilename, testETagFilename)
+		assert.Nil(s.T(), err)
+	}
+	assert.Equal(s.T(), 1, s.fullResponses, "unchanged file should only be downloaded once")
+
+	text, err := ioutil.ReadFile(testETagFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestConditionalDownloadLastModified() {
+	downloader := httpDownloader{}
+	for i := 0; i < 3; i++ {
+		err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testLastModifiedFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testLastModifiedFilename)
+		assert.Nil(s.T(), err)
+	}
+	assert.Equal(s.T(), 1, s.fullResponses, "unchanged file should only be downloaded once")
+
+	text, err := ioutil.ReadFile(testLastModifiedFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestConditionalDownloadLocalFileChanged() {
+	downloader := httpDownloader{}
+	err := downloader.Download(s.testServer.URL+"/"+testETagFilename, testETagFilename)
+	assert.Nil(s.T(), err)
+
+	assert.Nil(s.T(), ioutil.WriteFile(testETagFilename, []byte("tampered"), 0644))
+
+	err = downloader.Download(s.testServer.URL+"/"+testETagFilename, testETagFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, s.fullResponses, "locally modified file should be downloaded again")
+
+	text, err := ioutil.ReadFile(testETagFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadRetry() {
+	downloader := httpDownloader{retries: 2, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/"+testFlakyFilename, testFlakyFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 3, s.requests)
+
+	text, err := ioutil.ReadFile(testFlakyFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadRetriesExhausted() {
+	downloader := httpDownloader{retries: 1, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/"+testFlakyFilename, testFlakyFilename)
+	assert.NotNil(s.T(), err)
+	assert.Equal(s.T(), 2, s.requests)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadNoRetryOnClientError() {
+	downloader := httpDownloader{retries: 3, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/missing.txt", testFilename)
+	assert.NotNil(s.T(), err)
+	_, err = os.Stat(testFilename)
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadResumeInterrupted() {
+	downloader := httpDownloader{retries: 1, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/"+testInterruptedFilename, testInterruptedFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, s.requests)
+	assert.Equal(s.T(), 1, s.rangeRequests, "interrupted download should be resumed")
+
+	text, err := ioutil.ReadFile(testInterruptedFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+	_, err = os.Stat(httpPartialPath(testInterruptedFilename))
+	assert.True(s.T(), os.IsNotExist(err), "partial download should be cleaned up")
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadResumeAcrossRuns() {
+	downloader := httpDownloader{}
+	err := downloader.Download(s.testServer.URL+"/"+testInterruptedFilename, testInterruptedFilename)
+	assert.NotNil(s.T(), err)
+	_, err = os.Stat(testInterruptedFilename)
+	assert.True(s.T(), os.IsNotExist(err), "partial download must not be visible")
+
+	err = downloader.Download(s.testServer.URL+"/"+testInterruptedFilename, testInterruptedFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, s.rangeRequests, "partial download should be resumed by the next run")
+
+	text, err := ioutil.ReadFile(testInterruptedFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadResumeWrongRange() {
+	downloader := httpDownloader{retries: 2, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/"+testWrongRangeFilename, testWrongRangeFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 3, s.requests, "a wrong range should restart the download without a range")
+	assert.Equal(s.T(), 1, s.rangeRequests)
+
+	text, err := ioutil.ReadFile(testWrongRangeFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadIdleTimeout() {
+	downloader := httpDownloader{idleTimeout: 50 * time.Millisecond, retries: 1, retryBackoff: time.Millisecond}
+	err := downloader.Download(s.testServer.URL+"/"+testStalledFilename, testStalledFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, s.rangeRequests, "stalled download should be resumed")
+
+	text, err := ioutil.ReadFile(testStalledFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenNoFileExists() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	text, err := ioutil.ReadFile(testFilename)
@@ -114,9 +348,8 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenNoFileExists() {
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExists() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	text, err := ioutil.ReadFile(testFilename)
@@ -130,7 +363,7 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExists()
 	modtime := finfo.ModTime()
 
 	// Idempotent Download
-	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	newFinfo, err := os.Stat(testFilename)
@@ -143,9 +376,8 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExists()
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenOldFileExists() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	_, err = ioutil.ReadFile(testFilename)
@@ -161,7 +393,7 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenOldFileExists() {
 	time.Sleep(1 * time.Second)
 
 	// Idempotent Download
-	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	newFinfo, err := os.Stat(testFilename)
@@ -171,12 +403,27 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenOldFileExists() {
 	assert.NotEqual(s.T(), modtime, newModtime, "modification time should change")
 }
 
+func (s *HttpDownloaderTestSuite) TestIdempotentDownloadChecksumMismatchKeepsLocalFile() {
+	downloader := httpDownloader{}
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
+	assert.Nil(s.T(), err)
+
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testCorruptFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
+	assert.NotNil(s.T(), err)
+
+	text, err := ioutil.ReadFile(testFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testHashlessText, text, "a download that fails verification must not replace the local file")
+
+	_, err = os.Stat(stagedDownloadPath(testFilename))
+	assert.True(s.T(), os.IsNotExist(err), "unverified download should be removed")
+}
+
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExistsUsingChecksumUrl() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, s.testServer.URL+"/"+testChecksumUrlPath, testFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, s.testServer.URL+"/"+testChecksumUrlPath, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	text, err := ioutil.ReadFile(testFilename)
@@ -190,7 +437,7 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExistsUsi
 	modtime := finfo.ModTime()
 
 	// Idempotent Download
-	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.Nil(s.T(), err)
 
 	newFinfo, err := os.Stat(testFilename)
@@ -200,12 +447,47 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExistsUsi
 	assert.Equal(s.T(), modtime, newModtime, "modification time should not change")
 }
 
+func (s *HttpDownloaderTestSuite) TestIdempotentDownloadWhenCurrentFileExistsUsingSha256() {
+	downloader := httpDownloader{}
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, "sha256", testFilename)
+	assert.Nil(s.T(), err)
+
+	text, err := ioutil.ReadFile(testFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), text, testText, "file should download correctly")
+
+	finfo, err := os.Stat(testFilename)
+	assert.Nil(s.T(), err)
+
+	modtime := finfo.ModTime()
+
+	// Idempotent Download, with the algorithm inferred from the checksum URL
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, s.testServer.URL+"/"+testFilenameSha256Hash, testDefaultChecksumAlgorithm, testFilename)
+	assert.Nil(s.T(), err)
+
+	newFinfo, err := os.Stat(testFilename)
+	assert.Nil(s.T(), err)
+
+	assert.Equal(s.T(), modtime, newFinfo.ModTime(), "modification time should not change")
+}
+
+func (s *HttpDownloaderTestSuite) TestIdempotentDownloadChecksumAlgorithmMismatch() {
+	downloader := httpDownloader{}
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, s.testServer.URL+"/"+testFilenameSha256Hash, "sha512", testFilename)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *HttpDownloaderTestSuite) TestIdempotentDownloadUnsupportedChecksumAlgorithm() {
+	downloader := httpDownloader{}
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, "crc32", testFilename)
+	assert.NotNil(s.T(), err)
+}
+
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadNoRemoteHash() {
 	downloader := httpDownloader{
 		username: "",
-		password: "",
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testHashlessFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testHashlessFilename)
 	assert.Nil(s.T(), err)
 
 	text, err := ioutil.ReadFile(testHashlessFilename)
@@ -222,7 +504,7 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadNoRemoteHash() {
 	time.Sleep(1 * time.Second)
 
 	// Idempotent Download
-	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testHashlessFilename)
+	err = idempotentFileDownload(downloader, s.testServer.URL+"/"+testHashlessFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testHashlessFilename)
 	assert.Nil(s.T(), err)
 
 	newFinfo, err := os.Stat(testHashlessFilename)
@@ -235,9 +517,9 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadNoRemoteHash() {
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadBasicAuth() {
 	downloader := httpDownloader{
 		username: testBasicAuthUser,
-		password: testBasicAuthPass,
+		auth:     httpAuth{Password: secret{Value: testBasicAuthPass}},
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testBasicAuthFilename, testEmptyChecksumUrl, testBasicAuthFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testBasicAuthFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testBasicAuthFilename)
 	assert.Nil(s.T(), err)
 
 	text, err := ioutil.ReadFile(testBasicAuthFilename)
@@ -248,20 +530,95 @@ func (s *HttpDownloaderTestSuite) TestIdempotentDownloadBasicAuth() {
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadBasicAuthFailure() {
 	downloader := httpDownloader{
 		username: "nottherightuser",
-		password: "nottherightpass",
+		auth:     httpAuth{Password: secret{Value: "nottherightpass"}},
 	}
-	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testBasicAuthFilename, testEmptyChecksumUrl, testBasicAuthFilename)
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testBasicAuthFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testBasicAuthFilename)
 	assert.NotNil(s.T(), err)
 }
 
+func (s *HttpDownloaderTestSuite) TestDownloadBearerTokenFromFile() {
+	tokenFile, err := ioutil.TempFile("", "token")
+	assert.Nil(s.T(), err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.Close()
+
+	downloader := httpDownloader{auth: httpAuth{Token: secret{File: tokenFile.Name()}}}
+
+	// The token is read again on every request, so a rotated token is used without recreating the downloader
+	for _, token := range testTokens {
+		s.token = token
+		err = ioutil.WriteFile(tokenFile.Name(), []byte(token+"\n"), 0600)
+		assert.Nil(s.T(), err)
+
+		err = downloader.Download(s.testServer.URL+"/"+testTokenFilename, testTokenFilename)
+		assert.Nil(s.T(), err)
+	}
+
+	os.Remove(tokenFile.Name())
+	err = downloader.Download(s.testServer.URL+"/"+testTokenFilename, testTokenFilename)
+	assert.NotNil(s.T(), err, "missing token file should fail the download")
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadHeaderFromEnv() {
+	downloader := httpDownloader{auth: httpAuth{Headers: map[string]secret{testHeaderName: {Env: "ANSIBLE_PULLER_TEST_API_KEY"}}}}
+
+	err := downloader.Download(s.testServer.URL+"/"+testHeaderFilename, testHeaderFilename)
+	assert.NotNil(s.T(), err, "unset environment variable should fail the download")
+
+	os.Setenv("ANSIBLE_PULLER_TEST_API_KEY", testHeaderValue)
+	defer os.Unsetenv("ANSIBLE_PULLER_TEST_API_KEY")
+
+	err = downloader.Download(s.testServer.URL+"/"+testHeaderFilename, testHeaderFilename)
+	assert.Nil(s.T(), err)
+
+	text, err := ioutil.ReadFile(testHeaderFilename)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HttpDownloaderTestSuite) TestDownloadRedirectDropsCredentials() {
+	var forwarded http.Header
+	otherHost := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+		rw.Write(testText)
+	}))
+	defer otherHost.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, otherHost.URL+"/"+testHeaderFilename, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	os.Setenv("ANSIBLE_PULLER_TEST_API_KEY", testHeaderValue)
+	defer os.Unsetenv("ANSIBLE_PULLER_TEST_API_KEY")
+	downloader := httpDownloader{auth: httpAuth{
+		Token:   secret{Env: "ANSIBLE_PULLER_TEST_API_KEY"},
+		Headers: map[string]secret{testHeaderName: {Env: "ANSIBLE_PULLER_TEST_API_KEY"}},
+	}}
+
+	err := downloader.Download(redirect.URL+"/"+testHeaderFilename, testHeaderFilename)
+	assert.Nil(s.T(), err)
+	assert.NotNil(s.T(), forwarded, "redirect should be followed")
+	assert.Empty(s.T(), forwarded.Get(testHeaderName), "custom secret header must not reach another host")
+	assert.Empty(s.T(), forwarded.Get("Authorization"), "token must not reach another host")
+}
+
+func (s *HttpDownloaderTestSuite) TestIdempotentDownloadBasicAuthPasswordFromEnv() {
+	os.Setenv("ANSIBLE_PULLER_TEST_PASS", testBasicAuthPass)
+	defer os.Unsetenv("ANSIBLE_PULLER_TEST_PASS")
+
+	downloader := httpDownloader{username: testBasicAuthUser, auth: httpAuth{Password: secret{Env: "ANSIBLE_PULLER_TEST_PASS"}}}
+	err := idempotentFileDownload(downloader, s.testServer.URL+"/"+testBasicAuthFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testBasicAuthFilename)
+	assert.Nil(s.T(), err)
+}
+
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadFailureFromInvalidURL() {
 	downloader := httpDownloader{}
-	err := idempotentFileDownload(downloader, "http://192.168.0.%31/invalid-url", testEmptyChecksumUrl, testFilename)
+	err := idempotentFileDownload(downloader, "http://192.168.0.%31/invalid-url", testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.NotNil(s.T(), err)
 }
 
 func (s *HttpDownloaderTestSuite) TestIdempotentDownloadFailureFromUnresponsiveServer() {
 	downloader := httpDownloader{}
-	err := idempotentFileDownload(downloader, "http://0.0.0.0/unresponsive/"+testFilename, testEmptyChecksumUrl, testFilename)
+	err := idempotentFileDownload(downloader, "http://0.0.0.0/unresponsive/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, testFilename)
 	assert.NotNil(s.T(), err)
 }
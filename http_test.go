@@ -27,8 +27,14 @@ func TestStatusEndpoint(t *testing.T) {
 					"ansible_disabled": true,
 					"ansible_last_run_success": true,
 					"ansible_running": false,
+					"ansible_version": "",
 					"app_name": "ansible-puller",
+					"bundle": "",
 					"hostname": "%s",
+					"pinned_bundle": "",
+					"pinned_s3_version": "",
+					"source": "",
+					"source_version": "",
 					"version": ""
 				}`, host))
 	assert.JSONEq(t, expected, rr.Body.String())
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestHTTPTLSTestSuite(t *testing.T) {
+	suite.Run(t, new(HTTPTLSTestSuite))
+}
+
+// HTTPTLSTestSuite runs against a server that requires client certificates signed by its own CA
+type HTTPTLSTestSuite struct {
+	suite.Suite
+	tmpDir     string
+	testServer *httptest.Server
+	caFile     string
+	certFile   string
+	keyFile    string
+}
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA if parent is nil
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer := &testCertificate{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClientCertificate(t *testing.T, ca *testCertificate) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ansible-puller"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+// writeTestKeyPair writes the certificate and its key as PEM files
+func writeTestKeyPair(t *testing.T, cert *testCertificate, certFile, keyFile string) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.der}), 0600)
+	assert.Nil(t, err)
+
+	key, err := x509.MarshalECPrivateKey(cert.key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	assert.Nil(t, err)
+}
+
+func (s *HTTPTLSTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	ca := newTestCA(s.T())
+	server := newTestCertificate(s.T(), &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "artifacts"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+
+	s.caFile = filepath.Join(s.tmpDir, "ca.pem")
+	err = ioutil.WriteFile(s.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600)
+	assert.Nil(s.T(), err)
+
+	s.certFile = filepath.Join(s.tmpDir, "client.pem")
+	s.keyFile = filepath.Join(s.tmpDir, "client.key")
+	writeTestKeyPair(s.T(), newTestClientCertificate(s.T(), ca), s.certFile, s.keyFile)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	s.testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/" + testFilename:
+			rw.Write(testText)
+		case "/" + testFilenameHash:
+			rw.Write([]byte(testMD5))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	s.testServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	s.testServer.StartTLS()
+}
+
+func (s *HTTPTLSTestSuite) TearDownTest() {
+	s.testServer.Close()
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *HTTPTLSTestSuite) downloader() httpDownloader {
+	return httpDownloader{tls: httpTLSConfig{CAFile: s.caFile, CertFile: s.certFile, KeyFile: s.keyFile}}
+}
+
+// sharedDownloader returns a downloader whose requests share one client, like the downloader of a source
+func (s *HTTPTLSTestSuite) sharedDownloader() httpDownloader {
+	downloader, err := s.downloader().withClient()
+	assert.Nil(s.T(), err)
+	return downloader
+}
+
+func (s *HTTPTLSTestSuite) TestMutualTLSDownload() {
+	localFile := filepath.Join(s.tmpDir, testFilename)
+	err := idempotentFileDownload(s.downloader(), s.testServer.URL+"/"+testFilename, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, localFile)
+	assert.Nil(s.T(), err)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *HTTPTLSTestSuite) TestUntrustedServer() {
+	downloader := s.downloader()
+	downloader.tls.CAFile = ""
+
+	err := downloader.Download(s.testServer.URL+"/"+testFilename, filepath.Join(s.tmpDir, testFilename))
+	assert.NotNil(s.T(), err, "server certificate should not be trusted without the CA bundle")
+}
+
+func (s *HTTPTLSTestSuite) TestMissingClientCertificate() {
+	downloader := s.downloader()
+	downloader.tls.CertFile = ""
+	downloader.tls.KeyFile = ""
+
+	err := downloader.Download(s.testServer.URL+"/"+testFilename, filepath.Join(s.tmpDir, testFilename))
+	assert.NotNil(s.T(), err)
+
+	downloader.tls.CertFile = s.certFile
+	err = downloader.Download(s.testServer.URL+"/"+testFilename, filepath.Join(s.tmpDir, testFilename))
+	assert.NotNil(s.T(), err, "a client certificate without a key is a config error")
+}
+
+func (s *HTTPTLSTestSuite) TestCertificateRotation() {
+	downloader := s.sharedDownloader()
+	localFile := filepath.Join(s.tmpDir, testFilename)
+
+	err := downloader.Download(s.testServer.URL+"/"+testFilename, localFile)
+	assert.Nil(s.T(), err)
+
+	// Rotate to a certificate that the server does not trust, the next connection of the same client must pick it up
+	writeTestKeyPair(s.T(), newTestClientCertificate(s.T(), newTestCA(s.T())), s.certFile, s.keyFile)
+	s.testServer.CloseClientConnections()
+	err = downloader.Download(s.testServer.URL+"/"+testFilename, localFile)
+	assert.NotNil(s.T(), err, "rotated certificate should be used")
+}
+
+func (s *HTTPTLSTestSuite) TestCARotation() {
+	downloader := s.sharedDownloader()
+	localFile := filepath.Join(s.tmpDir, testFilename)
+
+	err := downloader.Download(s.testServer.URL+"/"+testFilename, localFile)
+	assert.Nil(s.T(), err)
+
+	// Rotate to a CA bundle that does not include the server's CA
+	err = ioutil.WriteFile(s.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCA(s.T()).der}), 0600)
+	assert.Nil(s.T(), err)
+	s.testServer.CloseClientConnections()
+	err = downloader.Download(s.testServer.URL+"/"+testFilename, localFile)
+	assert.NotNil(s.T(), err, "rotated CA bundle should be used")
+}
+
+func (s *HTTPTLSTestSuite) TestWrongServerName() {
+	downloader := s.downloader()
+	localURL := strings.Replace(s.testServer.URL, "127.0.0.1", "localhost", 1)
+
+	err := downloader.Download(localURL+"/"+testFilename, filepath.Join(s.tmpDir, testFilename))
+	assert.NotNil(s.T(), err, "server certificate should be checked against the host name")
+}
+
+func (s *HTTPTLSTestSuite) TestTLSMinVersion() {
+	downloader := s.downloader()
+	downloader.tls.MinVersion = "1.3"
+	s.testServer.TLS.MaxVersion = tls.VersionTLS12
+
+	err := downloader.Download(s.testServer.URL+"/"+testFilename, filepath.Join(s.tmpDir, testFilename))
+	assert.NotNil(s.T(), err, "server only offering TLS 1.2 should be refused")
+
+	_, err = parseTLSVersion("1.4")
+	assert.NotNil(s.T(), err)
+
+	version, err := parseTLSVersion("TLS1.3")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), uint16(tls.VersionTLS13), version)
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -17,61 +17,127 @@ type downloader interface {
 	RemoteChecksum(remotePath string) (string, error)
 }
 
-// Calculates the md5sum of a local file
-func md5sum(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
+// Interface for downloaders whose remote objects are identified by a version (e.g. a git commit SHA)
+// instead of a checksum of their contents
+type versionedDownloader interface {
+	downloader
+	RemoteVersion(remotePath string) (string, error)
+	DownloadVersion(remotePath, version, outputPath string) error
+}
+
+// Interface for downloaders that can look up the digests of a remote object from its metadata,
+// so that no separate checksum file has to be published next to it
+type digestDownloader interface {
+	downloader
+	RemoteDigests(remotePath string) (map[string]string, error)
+}
+
+// Interface for downloaders that can hand out the remote object as a stream, so that it can be extracted
+// while it is downloaded instead of being written to disk first
+type streamingDownloader interface {
+	downloader
+	Open(remotePath string) (io.ReadCloser, error)
+}
+
+// pickDigest chooses the digest to compare against from the digests of a remote object, keyed by algorithm.
+// A configured algorithm must be used if given, otherwise the strongest available one is.
+// Returns the fallback algorithm and "" if there is no suitable digest.
+func pickDigest(digests map[string]string, configured, fallback string) (string, string) {
+	if configured != "" {
+		if digest := digests[configured]; digest != "" {
+			return configured, digest
+		}
+		return fallback, ""
 	}
-	defer file.Close()
 
-	hash := md5.New()
-	_, err = io.Copy(hash, file)
-	if err != nil {
-		return "", err
+	for _, algorithm := range []string{"sha512", "sha256", "md5"} {
+		if digest := digests[algorithm]; digest != "" {
+			return algorithm, digest
+		}
 	}
 
-	byteHash := hash.Sum(nil)[:16]
-	return hex.EncodeToString(byteHash), nil
+	return fallback, ""
+}
+
+// Path of the file that records which remote version a local file was downloaded from
+func versionFilePath(localPath string) string {
+	return localPath + ".version"
 }
 
-func validateMd5Sum(path, checksum string) error {
-	newChecksum, err := md5sum(path)
+// Path of the sibling file that a download is written to until its checksum has been verified
+func stagedDownloadPath(localPath string) string {
+	return localPath + ".download"
+}
+
+// resolveRemoteChecksum looks up the checksum of the remote file, see idempotentFileDownload.
+// Returns the algorithm of the checksum, and "" as the checksum if there is none.
+func resolveRemoteChecksum(downloader downloader, remotePath, checksumURL, checksumAlgorithm string) (string, string, error) {
+	algorithm, err := resolveChecksumAlgorithm(checksumAlgorithm, checksumURL)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+
+	remoteChecksum := ""
+	if digester, ok := downloader.(digestDownloader); ok && len(checksumURL) == 0 {
+		digests, err := digester.RemoteDigests(remotePath)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to look up remote digests")
+		}
+		configured := ""
+		if checksumAlgorithm != "" {
+			configured = algorithm
+		}
+		algorithm, remoteChecksum = pickDigest(digests, configured, algorithm)
+		if remoteChecksum != "" {
+			logrus.Debugf("Using %s digest of %s from its metadata", algorithm, remotePath)
+		}
+	}
+
+	if remoteChecksum == "" {
+		if len(checksumURL) == 0 {
+			checksumURL = fmt.Sprintf("%s.%s", remotePath, algorithm)
+		}
+		logrus.Debugf("Looking up remote %s checksum of %s: %s", algorithm, remotePath, checksumURL)
+
+		remoteChecksum, err = downloader.RemoteChecksum(checksumURL)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "failed to download %s checksum", algorithm)
+		}
 	}
 
-	if newChecksum != checksum {
-		logrus.Debugf("Checksums for downloaded file do not match: '%s' != '%s'", newChecksum, checksum)
-		return errors.New("checksum does not match expected value")
+	if remoteChecksum != "" {
+		if err := ensureChecksumLength(remoteChecksum, algorithm); err != nil {
+			return "", "", errors.Wrap(err, "invalid remote checksum")
+		}
 	}
 
-	return nil
+	return algorithm, remoteChecksum, nil
 }
 
 // Downloads a file from a given url to a local filepath
-// Checks the md5sum of the file to see if the remote file should be downloaded
+// Checks the digest of the file to see if the remote file should be downloaded
 //
-// The MD5 checking may be an Artifactory-specific setup because it will look for the hash at "${url}.md5"
-// or will look for the hash in the path provided in http-checksum-url.
-// If the MD5 is not found, this will download the file
-func idempotentFileDownload(downloader downloader, remotePath, checksumURL, localPath string) error {
-	if len(checksumURL) == 0 {
-		checksumURL = fmt.Sprintf("%s.md5", remotePath)
+// The checksum lookup may be an Artifactory-specific setup because it will look for the hash at "${url}.${algorithm}"
+// (e.g. "${url}.md5") or will look for the hash in the path provided in http-checksum-url.
+// The algorithm is either given explicitly, inferred from the checksum URL suffix, or defaults to MD5.
+// Downloaders that know the digests of the remote object (e.g. from S3 object metadata) do not need a checksum file,
+// unless a checksum URL is given explicitly.
+// If the checksum is not found, this will download the file
+//
+// The local file is only ever replaced by a complete download that matches the remote checksum.
+func idempotentFileDownload(downloader downloader, remotePath, checksumURL, checksumAlgorithm, localPath string) error {
+	logrus.Debugf("Starting idempotent download of %s to %s", remotePath, localPath)
+	algorithm, remoteChecksum, err := resolveRemoteChecksum(downloader, remotePath, checksumURL, checksumAlgorithm)
+	if err != nil {
+		return err
 	}
-	logrus.Debugf("Starting idempotent download of %s to %s, remote checksum: %s", remotePath, localPath, checksumURL)
 
-	currentChecksum, err := md5sum(localPath)
+	currentChecksum, err := fileChecksum(localPath, algorithm)
 	if os.IsNotExist(err) {
 		logrus.Infof("File '%s' does not exist yet so cannot validate for new checksum", localPath)
 		currentChecksum = ""
 	} else if err != nil {
-		return errors.Wrap(err, "failed to calc local md5sum")
-	}
-
-	remoteChecksum, err := downloader.RemoteChecksum(checksumURL)
-	if err != nil {
-		return errors.Wrap(err, "failed to download md5sum")
+		return errors.Wrapf(err, "failed to calc local %s checksum", algorithm)
 	}
 
 	if currentChecksum != "" && remoteChecksum != "" {
@@ -83,20 +149,80 @@ func idempotentFileDownload(downloader downloader, remotePath, checksumURL, loca
 		}
 	}
 
+	// The local file will no longer hold a versioned download, in case it is shared with a versioned source
+	if err := os.Remove(versionFilePath(localPath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove stale version file")
+	}
+
 	logrus.Infof("Downloading file: %s", remotePath)
-	err = downloader.Download(remotePath, localPath)
+
+	// Without a remote checksum there is nothing to verify, and the downloaders never leave a partial file behind
+	if remoteChecksum == "" {
+		if err := downloader.Download(remotePath, localPath); err != nil {
+			return errors.Wrap(err, "failed to download")
+		}
+		return nil
+	}
+
+	// Otherwise the download only replaces the local file once it has been verified
+	stagedPath := stagedDownloadPath(localPath)
+	err = downloader.Download(remotePath, stagedPath)
 	if err != nil {
 		return errors.Wrap(err, "failed to download")
 	}
 
-	if remoteChecksum != "" {
-		logrus.Infof("Validating checksum: %s", remotePath)
+	logrus.Infof("Validating checksum: %s", remotePath)
+	err = validateChecksum(stagedPath, algorithm, remoteChecksum)
+	if err != nil {
+		os.Remove(stagedPath)
+		return errors.Wrapf(err, "failed to validate %s checksum", algorithm)
+	}
 
-		err = validateMd5Sum(localPath, remoteChecksum)
-		if err != nil {
-			return errors.Wrap(err, "failed to validate md5sum")
-		}
+	if err := os.Rename(stagedPath, localPath); err != nil {
+		return errors.Wrap(err, "failed to replace local file")
+	}
+	// HTTP cache validators only describe the file they were recorded for
+	if err := os.Remove(httpCacheValidatorsPath(stagedPath)); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to remove HTTP cache validators: %v", err)
 	}
 
 	return nil
 }
+
+// Downloads a versioned object to a local filepath
+// Compares the remote version to the one recorded next to the local file to see if it should be downloaded
+//
+// Returns the version that the local file holds afterwards.
+func idempotentVersionedDownload(downloader versionedDownloader, remotePath, localPath string) (string, error) {
+	remoteVersion, err := downloader.RemoteVersion(remotePath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve remote version")
+	}
+	logrus.Debugf("Starting idempotent download of %s to %s, remote version: %s", remotePath, localPath, remoteVersion)
+
+	versionFile := versionFilePath(localPath)
+	if _, err := os.Stat(localPath); err == nil {
+		currentVersion, err := ioutil.ReadFile(versionFile)
+		if err == nil && strings.TrimSpace(string(currentVersion)) == remoteVersion {
+			logrus.Debug("Local and remote versions match, skipping file download")
+			return remoteVersion, nil
+		}
+	}
+
+	// The recorded version must never describe a partially downloaded file
+	if err := os.Remove(versionFile); err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to remove stale version file")
+	}
+
+	logrus.Infof("Downloading file: %s at version %s", remotePath, remoteVersion)
+	err = downloader.DownloadVersion(remotePath, remoteVersion, localPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download")
+	}
+
+	if err := ioutil.WriteFile(versionFile, []byte(remoteVersion), 0644); err != nil {
+		return "", errors.Wrap(err, "failed to record downloaded version")
+	}
+
+	return remoteVersion, nil
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -22,6 +23,13 @@ var (
 	ansibleDisabled       = false
 	ansibleRunning        = false
 	ansibleLastRunSuccess = true
+	sourceName            = ""
+	sourceVersion         = ""
+	sourceBundle          = ""
+	pinnedBundle          = ""
+	pinnedS3Version       = ""
+	pinnedS3VersionSource = ""
+	ansibleVersion        = ""
 	Version               string
 
 	// Prometheus Metrics
@@ -65,6 +73,54 @@ var (
 		Name: "ansible_puller_last_exit_code",
 		Help: "Return code from the last ansible execution",
 	})
+	promSource = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ansible_puller_source",
+		Help: "Source that the Ansible repository was last pulled from",
+	},
+		[]string{"source"},
+	)
+	promSourceFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_puller_source_failures",
+		Help: "Number of failed attempts to pull the Ansible repository, per source",
+	},
+		[]string{"source"},
+	)
+	promSourceVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ansible_puller_source_version",
+		Help: "Version of the Ansible repository that was last pulled, e.g. the git commit or OCI manifest digest",
+	},
+		[]string{"version"},
+	)
+	promHTTPDownloadRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ansible_puller_http_download_retries",
+		Help: "Number of times a failed HTTP download was retried",
+	})
+	promVenvUpdated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ansible_puller_venv_updated",
+		Help: "Whether the last run had to run pip install, because the requirements, Python or pip changed",
+	})
+	promVenvUpdateTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ansible_puller_venv_update_seconds",
+		Help: "Time it took to update the virtualenv in the last run, including checking whether it was needed",
+	})
+	promVenvFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ansible_puller_venv_fallbacks",
+		Help: "Number of times a broken blue/green virtualenv was replaced by the previous one",
+	})
+	promRunDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ansible_puller_run_decisions",
+		Help: "Number of runs by whether they ran or were skipped, and why",
+	},
+		[]string{"decision"},
+	)
+	promLastRunSkipped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ansible_puller_last_run_skipped",
+		Help: "Whether the last run was skipped because the bundle was unchanged",
+	})
+	promSignatureVerificationFailed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ansible_puller_signature_verification_failed",
+		Help: "Whether or not the signature of the last pulled tarball failed verification",
+	})
 )
 
 func init() {
@@ -77,6 +133,16 @@ func init() {
 	prometheus.MustRegister(promAnsibleSummary)
 	prometheus.MustRegister(promVersion)
 	prometheus.MustRegister(promDebug)
+	prometheus.MustRegister(promSignatureVerificationFailed)
+	prometheus.MustRegister(promSource)
+	prometheus.MustRegister(promSourceFailures)
+	prometheus.MustRegister(promSourceVersion)
+	prometheus.MustRegister(promHTTPDownloadRetries)
+	prometheus.MustRegister(promVenvUpdated)
+	prometheus.MustRegister(promVenvUpdateTime)
+	prometheus.MustRegister(promVenvFallbacks)
+	prometheus.MustRegister(promRunDecisions)
+	prometheus.MustRegister(promLastRunSkipped)
 
 	viper.SetConfigName(appName)
 	viper.AddConfigPath(fmt.Sprintf("/etc/%s/", appName))
@@ -87,20 +153,74 @@ func init() {
 	pflag.String("http-proto", "https", "Set to 'http' if necessary")
 	pflag.String("http-user", "", "HTTP username for pulling the remote file")
 	pflag.String("http-pass", "", "HTTP password for pulling the remote file")
+	pflag.String("http-pass-file", "", "File to read the HTTP password from on every request, instead of http-pass")
+	pflag.String("http-pass-env", "", "Environment variable to read the HTTP password from on every request, instead of http-pass")
+	pflag.String("http-token", "", "Bearer token for pulling the remote file, used instead of basic auth")
+	pflag.String("http-token-file", "", "File to read the bearer token from on every request")
+	pflag.String("http-token-env", "", "Environment variable to read the bearer token from on every request")
+	pflag.StringToString("http-headers", map[string]string{}, "Additional HTTP headers to send, e.g. X-JFrog-Art-Api=<key>")
+	pflag.StringToString("http-header-files", map[string]string{}, "Additional HTTP headers whose values are read from a file on every request, e.g. X-JFrog-Art-Api=/run/secrets/artifactory")
+	pflag.StringToString("http-header-envs", map[string]string{}, "Additional HTTP headers whose values are read from an environment variable on every request")
 
 	pflag.String("http-url", "", "Remote endpoint to retrieve the file from")
 	pflag.String("http-checksum-url", "", "Remote endpoint to retrieve the checksum from")
+	pflag.String("http-ca-file", "", "PEM bundle of CAs to trust for the HTTP source instead of the system roots")
+	pflag.String("http-client-cert", "", "PEM client certificate to present to the HTTP source")
+	pflag.String("http-client-key", "", "PEM private key of http-client-cert")
+	pflag.String("http-tls-min-version", defaultHTTPTLSMinVersion, "Minimum TLS version for the HTTP source: 1.0, 1.1, 1.2 or 1.3")
+	pflag.Duration("http-connect-timeout", defaultHTTPConnectTimeout, "Time allowed to connect to the HTTP server, including the TLS handshake")
+	pflag.Duration("http-header-timeout", defaultHTTPHeaderTimeout, "Time allowed for the HTTP response headers to arrive")
+	pflag.Duration("http-idle-timeout", defaultHTTPIdleTimeout, "Time allowed without receiving data before an HTTP download is interrupted")
+	pflag.Int("http-retries", 3, "Number of times a failed HTTP download is retried. Interrupted downloads are resumed where possible")
+	pflag.Duration("http-retry-backoff", defaultHTTPRetryBackoff, "Wait before the first HTTP download retry, doubled on every further retry, with jitter")
+	pflag.String("checksum-algorithm", "", "Digest algorithm of the remote checksum: md5, sha256 or sha512. Inferred from the checksum URL suffix if not set, otherwise md5")
 	pflag.String("s3-arn", "", "Remote object ARN in S3 to retrieve")
+	pflag.String("s3-uri", "", "Remote object URI in S3 to retrieve, e.g. s3://bucket/infra.tgz")
+	pflag.String("s3-bucket", "", "S3 bucket to retrieve s3-key from, instead of s3-arn or s3-uri")
+	pflag.String("s3-key", "", "Key of the remote object in s3-bucket")
 	pflag.String("s3-conn-region", "", "AWS service endpoint region for S3")
+	pflag.Bool("s3-versioned", false, "Identify the S3 object by its VersionId instead of a checksum, for buckets with versioning enabled")
+	pflag.String("s3-version-id", "", "VersionId of the S3 object to deploy instead of the latest one")
+	pflag.String("s3-profile", "", "Shared AWS config profile to use for S3, instead of the default one")
+	pflag.String("s3-role-arn", "", "IAM role to assume for reading from S3, e.g. in another account")
+	pflag.String("s3-external-id", "", "External ID to pass when assuming s3-role-arn")
+	pflag.String("s3-web-identity-token-file", "", "OIDC token file to assume s3-role-arn with, instead of the base AWS credentials")
+	pflag.Bool("s3-self-test", true, "Check at startup that the S3 credentials work and the object can be read")
+	pflag.String("s3-endpoint", "", "Custom S3 endpoint URL, e.g. for MinIO or Ceph RGW")
+	pflag.Bool("s3-path-style", false, "Use path-style addressing (endpoint/bucket/key) for S3, as most S3-compatible stores require")
+	pflag.String("git-url", "", "Remote git repository to retrieve the Ansible repository from")
+	pflag.String("git-ref", "HEAD", "Branch, tag or full commit SHA of git-url to deploy")
+	pflag.String("git-cache-dir", "/var/cache/"+appName+"/git", "Path to the local bare repository caching git-url")
+	pflag.String("oci-ref", "", "OCI artifact to retrieve the tarball layer from, e.g. registry.example.com/infra/ansible:production")
+	pflag.String("oci-user", "", "Username for the OCI registry")
+	pflag.String("oci-pass", "", "Password for the OCI registry")
+	pflag.StringSlice("signature-public-keys", []string{}, "List of files with trusted public keys, comma-separated. When set, the tarball signature is verified before extraction")
+	pflag.String("signature-url", "", "Remote endpoint to retrieve the detached tarball signature from. Defaults to the remote resource + '.sig'")
+
+	pflag.String("cache-dir", "/var/cache/"+appName, "Directory to keep downloaded and previously pulled tarballs in")
+	pflag.Int("cache-keep", 5, "Number of previously pulled tarballs to keep in the cache, in addition to the last applied one")
+	pflag.Bool("skip-unchanged", false, "Skip extracting and running a bundle that is unchanged since the last successful run")
+	pflag.Duration("force-run-interval", 24*time.Hour, "Run an unchanged bundle anyway after this long, to correct drift. 0 never forces a run")
+	pflag.Bool("stream-extract", false, "Extract tarballs while they are downloaded instead of keeping them on disk, requires a remote checksum")
+	pflag.Int64("extract-max-bytes", 4<<30, "Maximum total size of the files extracted from a tarball, 0 for no limit")
+	pflag.Int("extract-max-files", 100000, "Maximum number of entries extracted from a tarball, 0 for no limit")
+	pflag.String("pin-bundle", "", "Digest (or unique prefix) of a cached tarball to run instead of pulling, e.g. to roll back")
+	pflag.Bool("list-bundles", false, "Print the cached tarballs, then exit")
 
 	pflag.String("log-dir", "/var/log/"+appName, "Logging directory")
 	pflag.StringSlice("ansible-inventory", []string{}, "List of ansible inventories to look in, comma-separated, relative to ansible-dir")
 	pflag.String("ansible-playbook", "site.yml", "Path in the pulled tarball to the playbook to run, relative to ansible-dir")
 	pflag.String("ansible-dir", "", "Path in the pulled tarball to cd into before ansible commands - usually dir where ansible.cfg is")
 
+	pflag.Bool("venv-disabled", false, "Run a pre-installed Ansible from ansible-prefix or $PATH instead of a virtual environment")
+	pflag.String("ansible-prefix", "", "Install prefix of the pre-installed Ansible, with the executables in bin, when venv-disabled is set. $PATH is used if empty")
 	pflag.String("venv-python", "/usr/bin/python3", "Path to the Python executable to be used for building the virtual environment")
 	pflag.String("venv-path", "/root/.virtualenvs/ansible_puller", "Path to house the virtual environment")
 	pflag.String("venv-requirements-file", "requirements.txt", "Relative path in the pulled tarball of the requirements file to populate the virtual environment")
+	pflag.String("venv-backend", venvBackendPip, "How to build the virtual environment: pip, uv, pip-sync or tarball, see the README")
+	pflag.String("venv-wheelhouse", "wheelhouse", "Relative path in the pulled tarball of a directory of wheels to install the requirements from, without a package index, if it exists")
+	pflag.Bool("venv-blue-green", false, "Build changed virtual environments next to the live one, and switch venv-path over to them once the smoke test passes")
+	pflag.String("venv-smoke-test", "ansible --version", "Command in the virtual environment that must succeed before switching to a blue/green virtual environment")
 
 	pflag.Int("sleep", 30, "Number of minutes to sleep between runs")
 	pflag.Int("sleep-jitter", 0, "Number of maxium minutes to jitter between runs. When set, the actual sleep time between each run will be uniformly distributed between [sleep-jitter, sleep+jitter)")
@@ -133,6 +253,30 @@ func init() {
 		ansibleDisable()
 	}
 
+	pinnedBundle = viper.GetString("pin-bundle")
+	// Bundles pinned through the HTTP API stay pinned across restarts, unless another one is given on the command line
+	if pinnedBundle == "" {
+		if pinned, err := newBundleCache().Pinned(); err != nil {
+			logrus.Errorln("Unable to read the pinned bundle: ", err)
+		} else if pinned != "" {
+			pinnedBundle = pinned
+			logrus.Infoln("Restored pinned bundle ", pinned)
+		}
+	}
+
+	if err := newBundleCache().MigrateLegacy(); err != nil {
+		logrus.Errorln("Unable to migrate the bundle cache: ", err)
+	}
+
+	// S3 object versions pinned through the HTTP API stay pinned across restarts
+	if pin, err := newBundleCache().S3Pin(); err != nil {
+		logrus.Errorln("Unable to read the pinned S3 object version: ", err)
+	} else if pin.Version != "" {
+		pinnedS3Version = pin.Version
+		pinnedS3VersionSource = pin.Source
+		logrus.Infoln("Restored pinned S3 object version ", pin.Version)
+	}
+
 	hostname, err = os.Hostname()
 	if err != nil {
 		logrus.Fatal("Unable to detect hostname")
@@ -152,45 +296,151 @@ func ansibleEnable() {
 	logrus.Infoln("Enabled Ansible-Puller")
 }
 
-func getAnsibleRepository(runDir string) error {
-	httpURL := viper.GetString("http-url")
-	checksumURL := viper.GetString("http-checksum-url")
-	s3Obj := viper.GetString("s3-arn")
-	s3ConnectionRegion := viper.GetString("s3-conn-region")
-	localCacheFile := fmt.Sprintf("/tmp/%s.tgz", appName)
-	var err error
-
-	// Exactly one variable is defined
-	if (httpURL == "") == (s3Obj == "") {
-		return errors.New("exactly one remote resource must be specified. Choose one 'http-url' or 's3-arn'")
-	} else if httpURL != "" {
-		remoteHttpURL := fmt.Sprintf("%s://%s", viper.GetString("http-proto"), httpURL)
-		downloader := httpDownloader{
-			username: viper.GetString("http-user"),
-			password: viper.GetString("http-pass"),
+// newBundleCache returns the configured cache of pulled tarballs
+func newBundleCache() bundleCache {
+	return bundleCache{
+		Dir:  filepath.Join(viper.GetString("cache-dir"), "bundles"),
+		Keep: viper.GetInt("cache-keep"),
+	}
+}
+
+// newExtractLimits returns the configured limits for extracting tarballs
+func newExtractLimits() extractLimits {
+	return extractLimits{
+		MaxBytes: viper.GetInt64("extract-max-bytes"),
+		MaxFiles: viper.GetInt("extract-max-files"),
+	}
+}
+
+// selfTestSources reports credential problems of the sources at startup, instead of on the first pull
+func selfTestSources() {
+	sources, err := loadSources()
+	if err != nil {
+		// Reported by the first run
+		return
+	}
+
+	for _, source := range sources {
+		if err := source.selfTest(); err != nil {
+			logrus.Errorf("Self-test of source %s failed: %v", source.label(), err)
+			continue
 		}
-		err = idempotentFileDownload(downloader, remoteHttpURL, checksumURL, localCacheFile)
-	} else if s3Obj != "" {
-		downloader, createError := createS3Downloader(s3ConnectionRegion)
-		if createError != nil {
-			return errors.Wrap(err, "unable to pull Ansible repo")
+		if source.s3Resource() != "" {
+			logrus.Infof("Self-test of source %s passed", source.label())
 		}
-		err = idempotentFileDownload(downloader, s3Obj, checksumURL, localCacheFile)
 	}
+}
+
+// getAnsibleRepository pulls the Ansible repository and extracts it into runDir.
+//
+// If a bundle is pinned, it is taken from the bundle cache instead of being pulled.
+// A bundle with the digest skipDigest is not extracted, as its run is going to be skipped.
+// Returns the digest of the bundle.
+func getAnsibleRepository(runLogger *logrus.Entry, runDir, skipDigest string) (string, error) {
+	signatureKeys := viper.GetStringSlice("signature-public-keys")
+	localCacheFile := filepath.Join(viper.GetString("cache-dir"), appName+".tgz")
+	cache := newBundleCache()
+
+	if pinnedBundle != "" {
+		entry, err := cache.Get(pinnedBundle)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to find pinned bundle")
+		}
+
+		runLogger.Infoln("Using pinned bundle ", entry.Digest, " instead of pulling")
+		setSource(entry)
+		if entry.Digest == skipDigest {
+			return entry.Digest, nil
+		}
+		if err := extractArchive(cache.Path(entry.Digest), runDir, newExtractLimits()); err != nil {
+			return "", errors.Wrap(err, "unable to extract archive")
+		}
+
+		return entry.Digest, nil
+	}
+
+	sources, err := loadSources()
 	if err != nil {
-		return errors.Wrap(err, "unable to pull Ansible repo")
+		return "", err
+	}
+
+	if pinnedS3Version != "" {
+		runLogger.Infoln("Using pinned S3 object version ", pinnedS3Version)
+		if err := pinS3Version(sources, pinnedS3VersionSource, pinnedS3Version); err != nil {
+			return "", errors.Wrap(err, "unable to pin S3 object version")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localCacheFile), 0700); err != nil {
+		return "", errors.Wrap(err, "unable to create cache dir")
 	}
 
-	err = extractTgz(localCacheFile, runDir)
+	entry, err := pullFromSources(runLogger, sources, cache, runDir, localCacheFile, signatureKeys, skipDigest)
 	if err != nil {
-		return errors.Wrap(err, "unable to extract tgz")
+		return "", errors.Wrap(err, "unable to pull Ansible repo")
 	}
 
-	return nil
+	setSource(entry)
+
+	return entry.Digest, nil
+}
+
+// setSource records the source, version and digest of the Ansible repository that is being deployed
+func setSource(entry bundleCacheEntry) {
+	sourceName = entry.Source
+	promSource.Reset()
+	promSource.WithLabelValues(entry.Source).Set(1)
+
+	sourceVersion = entry.Version
+	promSourceVersion.Reset()
+	if entry.Version != "" {
+		promSourceVersion.WithLabelValues(entry.Version).Set(1)
+	}
+
+	sourceBundle = entry.Digest
+}
+
+// Reasons for running or skipping a run, see skippableBundle
+const (
+	runDecisionChanged   = "changed"   // The bundle changed since the last successful run, or there was none
+	runDecisionUnchanged = "unchanged" // The bundle is unchanged, the run was skipped
+	runDecisionInterval  = "interval"  // The bundle is unchanged, but force-run-interval passed since the last successful run
+	runDecisionManual    = "manual"    // The run was triggered manually
+)
+
+// skippableBundle returns the digest of the last successfully applied bundle if its run may be skipped,
+// should it be pulled again. Otherwise returns "" and the reason why the run must happen.
+func skippableBundle(cache bundleCache, forced bool) (string, string) {
+	if forced {
+		return "", runDecisionManual
+	}
+
+	applied, err := cache.Applied()
+	if err != nil {
+		logrus.Warnln("Unable to look up the last applied bundle: ", err)
+		return "", runDecisionChanged
+	}
+	if applied == "" {
+		return "", runDecisionChanged
+	}
+
+	appliedAt, err := cache.AppliedAt()
+	if err != nil {
+		logrus.Warnln("Unable to look up when the last bundle was applied: ", err)
+		return "", runDecisionChanged
+	}
+	if interval := viper.GetDuration("force-run-interval"); interval > 0 && time.Since(appliedAt) >= interval {
+		return "", runDecisionInterval
+	}
+
+	return applied, ""
 }
 
 // Core run logic
-func ansibleRun() error {
+//
+// With 'skip-unchanged', runs that are not forced are skipped if the bundle did not change since the last
+// successful run. Runs triggered through the HTTP API are always forced.
+func ansibleRun(forced bool) error {
 	if ansibleDisabled {
 		logrus.Infoln("Tried to run Ansible, but currently disabled. Skipping.")
 		return nil
@@ -217,24 +467,74 @@ func ansibleRun() error {
 		defer os.RemoveAll(runDir)
 	}
 
+	skipDigest, decision := "", ""
+	if viper.GetBool("skip-unchanged") {
+		skipDigest, decision = skippableBundle(newBundleCache(), forced)
+	}
+
 	runLogger.Infoln("Pulling remote repository")
-	if err = getAnsibleRepository(runDir); err != nil {
+	bundleDigest, err := getAnsibleRepository(runLogger, runDir, skipDigest)
+	if err != nil {
 		runLogger.Errorln("Unable to pull ansible repository: ", err)
 		return err
 	}
 
-	vCfg := VenvConfig{
-		Path:   viper.GetString("venv-path"),
-		Python: viper.GetString("venv-python"),
+	if viper.GetBool("skip-unchanged") {
+		if skipDigest != "" {
+			decision = runDecisionChanged
+			if bundleDigest == skipDigest {
+				decision = runDecisionUnchanged
+			}
+		}
+		promRunDecisions.WithLabelValues(decision).Inc()
+
+		if decision == runDecisionUnchanged {
+			promLastRunSkipped.Set(1)
+			runLogger.Infoln("Bundle ", bundleDigest, " is unchanged since the last successful run, skipping the run")
+			return nil
+		}
+		promLastRunSkipped.Set(0)
+		runLogger.Infoln("Running bundle ", bundleDigest, ", reason: ", decision)
 	}
 
-	runLogger.Infoln("Ensuring virtualenv exists")
-	if err = vCfg.Ensure(); err != nil {
-		return err
+	vCfg := VenvConfig{
+		Path:      viper.GetString("venv-path"),
+		Python:    viper.GetString("venv-python"),
+		Backend:   viper.GetString("venv-backend"),
+		BlueGreen: viper.GetBool("venv-blue-green"),
+		SmokeTest: strings.Fields(viper.GetString("venv-smoke-test")),
+		Disabled:  viper.GetBool("venv-disabled"),
+		Prefix:    viper.GetString("ansible-prefix"),
 	}
-	runLogger.Infoln("Updating virtualenv")
-	if err = vCfg.Update(filepath.Join(runDir, viper.GetString("venv-requirements-file"))); err != nil {
-		return err
+	if wheelhouse := viper.GetString("venv-wheelhouse"); wheelhouse != "" {
+		wheelhouse = filepath.Join(runDir, wheelhouse)
+		if info, err := os.Stat(wheelhouse); err == nil && info.IsDir() {
+			vCfg.Wheelhouse = wheelhouse
+		}
+	}
+
+	if vCfg.Disabled {
+		runLogger.Infoln("Virtualenv disabled, using the pre-installed Ansible")
+	} else {
+		runLogger.Infoln("Ensuring virtualenv exists")
+		if err = vCfg.Ensure(); err != nil {
+			return err
+		}
+		runLogger.Infoln("Updating virtualenv")
+		venvUpdateStart := time.Now()
+		venvUpdated, err := vCfg.Update(filepath.Join(runDir, viper.GetString("venv-requirements-file")))
+		promVenvUpdateTime.Set(time.Since(venvUpdateStart).Seconds())
+		if venvUpdated {
+			promVenvUpdated.Set(1)
+		} else {
+			promVenvUpdated.Set(0)
+		}
+		if err != nil {
+			return err
+		}
+		if !venvUpdated {
+			runLogger.Infoln("Requirements unchanged, virtualenv is up to date")
+		}
 	}
 
 	aCfg := AnsibleConfig{
@@ -243,6 +543,13 @@ func ansibleRun() error {
 		InventoryList: viper.GetStringSlice("ansible-inventory"),
 	}
 
+	if version, err := aCfg.Version(); err != nil {
+		runLogger.Warnln("Unable to detect the Ansible version: ", err)
+	} else {
+		ansibleVersion = version
+		runLogger.Infoln("Using Ansible ", version)
+	}
+
 	runLogger.Infoln("Finding inventory for the current host")
 	inventory, target, err := aCfg.FindInventoryForHost()
 	if err != nil {
@@ -264,6 +571,10 @@ func ansibleRun() error {
 	runOutput, ansibleRunErr := ansibleRunner.Run()
 	if ansibleRunErr == nil {
 		promAnsibleLastSuccess.Set(float64(time.Now().Unix()))
+
+		if err := newBundleCache().MarkApplied(bundleDigest); err != nil {
+			runLogger.Errorln("Unable to record the applied bundle: ", err)
+		}
 	}
 
 	promAnsibleLastExitCode.Set(float64(runOutput.CommandOutput.Exitcode))
@@ -295,8 +606,28 @@ func main() {
 		return
 	}
 
+	if viper.GetBool("list-bundles") {
+		entries, err := newBundleCache().List()
+		if err != nil {
+			logrus.Fatalln("Unable to list cached bundles: " + err.Error())
+		}
+		for _, entry := range entries {
+			applied := ""
+			if entry.Applied {
+				applied = "(applied)"
+			}
+			fmt.Printf("%s  %s  %s %s %s\n", entry.Digest, entry.Pulled.Format(time.RFC3339), entry.Source, entry.Version, applied)
+		}
+		return
+	}
+
+	if viper.GetBool("s3-self-test") {
+		selfTestSources()
+	}
+
 	if viper.GetBool("once") {
-		if err := ansibleRun(); err != nil {
+		// Like a scheduled run, so that cron jobs and systemd timers skip unchanged bundles; a pinned bundle always runs
+		if err := ansibleRun(pinnedBundle != ""); err != nil {
 			logrus.Fatalln("Ansible run failed due to: " + err.Error())
 		}
 
@@ -312,20 +643,24 @@ func main() {
 		logrus.Fatalf("sleep-jitter is too large, it must be less than the 'sleep' period %d", viper.GetInt("sleep"))
 	}
 
+	// Runs are triggered by sending whether they are forced, i.e. triggered manually
 	runChan := make(chan bool)
-	runOnce := func() {
+	trigger := func(forced bool) {
 		// Non-blocking send to the run channel. If it's already running, this will be a no-op.
 		select {
-		case runChan <- true:
+		case runChan <- forced:
 		default:
 		}
 	}
+	runOnce := func() {
+		trigger(true)
+	}
 
 	go func() {
-		runChan <- true // block until the first run is triggered
+		runChan <- false // block until the first run is triggered
 		if jitter == 0 {
 			for range time.Tick(period) {
-				runOnce()
+				trigger(false)
 			}
 			return
 		}
@@ -333,15 +668,15 @@ func main() {
 		for {
 			// Sleep for a random duration in [period - jitter, period + jitter).
 			time.Sleep(period - jitter + time.Duration(rng.Int63n(2*int64(jitter))))
-			runOnce()
+			trigger(false)
 		}
 	}()
 
 	go func() {
 		logrus.Infoln(fmt.Sprintf("Launching Ansible Runner. Runs %d minutes (with %d mintues jitter) apart.", viper.GetInt("sleep"), viper.GetInt("sleep-jitter")))
-		for range runChan {
+		for forced := range runChan {
 			start := time.Now()
-			err := ansibleRun()
+			err := ansibleRun(forced)
 			elapsed := time.Since(start)
 
 			promAnsibleRunTime.Set(elapsed.Seconds())
@@ -0,0 +1,370 @@
+// Helper methods for pulling the Ansible tarball from an OCI registry
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociTitleAnnotation      = "org.opencontainers.image.title"
+)
+
+// Matches the key="value" pairs of a WWW-Authenticate challenge
+var ociChallengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// ociReference points to an artifact in an OCI registry, e.g. "registry.example.com/infra/ansible:production"
+type ociReference struct {
+	Scheme     string // "https" unless the reference was given with an explicit "http://" prefix
+	Registry   string // registry host, including the port if any
+	Repository string // repository name within the registry
+	Reference  string // tag or digest
+}
+
+// ociDescriptor describes a blob within an OCI manifest
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociManifest is the subset of an OCI image manifest that is needed to find the tarball layer
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociDownloader pulls a compressed tarball layer of an OCI artifact using the distribution protocol.
+//
+// Artifacts are identified by their manifest digest, which is used for idempotency instead of a checksum file.
+type ociDownloader struct {
+	downloader
+	username string
+	password string
+}
+
+func parseOCIReference(ref string) (*ociReference, error) {
+	parsed := &ociReference{Scheme: "https"}
+	for _, scheme := range []string{"http", "https"} {
+		if strings.HasPrefix(ref, scheme+"://") {
+			parsed.Scheme = scheme
+			ref = strings.TrimPrefix(ref, scheme+"://")
+		}
+	}
+
+	slash := strings.Index(ref, "/")
+	if slash <= 0 {
+		return nil, fmt.Errorf("not a valid OCI reference, registry and repository are required: %s", ref)
+	}
+	parsed.Registry = ref[:slash]
+	name := ref[slash+1:]
+
+	if at := strings.Index(name, "@"); at >= 0 {
+		parsed.Repository, parsed.Reference = name[:at], name[at+1:]
+	} else if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		parsed.Repository, parsed.Reference = name[:colon], name[colon+1:]
+	} else {
+		parsed.Repository, parsed.Reference = name, "latest"
+	}
+
+	if parsed.Repository == "" || parsed.Reference == "" {
+		return nil, fmt.Errorf("not a valid OCI reference: %s", ref)
+	}
+
+	return parsed, nil
+}
+
+func (r ociReference) url(kind, reference string) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", r.Scheme, r.Registry, r.Repository, kind, reference)
+}
+
+// isDigest reports whether the reference is a content digest rather than a tag
+func (r ociReference) isDigest() bool {
+	return strings.Contains(r.Reference, ":")
+}
+
+// splitDigest splits "sha256:<hex>" into a supported checksum algorithm and its hex digest
+func splitDigest(digest string) (string, string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("not a valid digest: %s", digest)
+	}
+	if _, ok := checksumAlgorithms[parts[0]]; !ok {
+		return "", "", fmt.Errorf("unsupported digest algorithm: %s", parts[0])
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// fetchToken exchanges the credentials for a bearer token, as described by a registry's auth challenge.
+func (downloader ociDownloader) fetchToken(client *http.Client, challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range ociChallengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("auth challenge without realm: %s", challenge)
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+
+	req, err := http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create token request")
+	}
+	if downloader.username != "" && downloader.password != "" {
+		req.SetBasicAuth(downloader.username, downloader.password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get registry token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("bad status code from token endpoint: %v", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed to parse registry token")
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	return token.AccessToken, nil
+}
+
+// do sends a request to the registry, answering a Basic or Bearer auth challenge if one is returned.
+func (downloader ociDownloader) do(client *http.Client, method, requestURL string, accept ...string) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, requestURL, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create request")
+		}
+		for _, mediaType := range accept {
+			req.Header.Add("Accept", mediaType)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		token, err := downloader.fetchToken(client, challenge)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case downloader.username != "" && downloader.password != "":
+		req.SetBasicAuth(downloader.username, downloader.password)
+	default:
+		return nil, errors.New("registry requires authentication, but no credentials were configured")
+	}
+
+	return client.Do(req)
+}
+
+// RemoteVersion resolves the tag of the reference to its manifest digest.
+func (downloader ociDownloader) RemoteVersion(remotePath string) (string, error) {
+	ref, err := parseOCIReference(remotePath)
+	if err != nil {
+		return "", err
+	}
+	if ref.isDigest() {
+		return ref.Reference, nil
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := downloader.do(client, "HEAD", ref.url("manifests", ref.Reference), ociManifestMediaType, dockerManifestMediaType)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve tag")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("bad status code resolving tag %s: %v", ref.Reference, resp.StatusCode)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// The digest header is optional, so fall back to hashing the manifest itself
+		digest, err = downloader.manifestDigest(client, ref)
+		if err != nil {
+			return "", err
+		}
+	}
+	logrus.Debugf("Resolved OCI tag %s to %s", ref.Reference, digest)
+
+	return digest, nil
+}
+
+// manifestDigest fetches the manifest that the reference points to and returns its SHA-256 digest.
+func (downloader ociDownloader) manifestDigest(client *http.Client, ref *ociReference) (string, error) {
+	resp, err := downloader.do(client, "GET", ref.url("manifests", ref.Reference), ociManifestMediaType, dockerManifestMediaType)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("bad status code getting manifest: %v", resp.StatusCode)
+	}
+
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read manifest")
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(manifestBytes)), nil
+}
+
+// findTarballLayer picks the layer holding the compressed tarball from a manifest
+func findTarballLayer(manifest ociManifest) (*ociDescriptor, error) {
+	if len(manifest.Layers) == 1 {
+		return &manifest.Layers[0], nil
+	}
+
+	for i, layer := range manifest.Layers {
+		title := layer.Annotations[ociTitleAnnotation]
+		if strings.HasSuffix(layer.MediaType, "gzip") || strings.HasSuffix(layer.MediaType, "zstd") ||
+			strings.HasSuffix(title, ".tgz") || strings.HasSuffix(title, ".tar.gz") || strings.HasSuffix(title, ".tar.zst") {
+			return &manifest.Layers[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the %d layers is a compressed tarball", len(manifest.Layers))
+}
+
+// DownloadVersion fetches the manifest with the given digest and writes its tarball layer to outputPath.
+func (downloader ociDownloader) DownloadVersion(remotePath, version, outputPath string) (err error) {
+	ref, err := parseOCIReference(remotePath)
+	if err != nil {
+		return
+	}
+	algorithm, expected, err := splitDigest(version)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := downloader.do(client, "GET", ref.url("manifests", version), ociManifestMediaType, dockerManifestMediaType)
+	if err != nil {
+		return errors.Wrap(err, "failed to get manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("bad status code getting manifest: %v", resp.StatusCode)
+	}
+
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read manifest")
+	}
+	manifestHash := checksumAlgorithms[algorithm]()
+	manifestHash.Write(manifestBytes)
+	if fmt.Sprintf("%x", manifestHash.Sum(nil)) != expected {
+		return fmt.Errorf("manifest does not match digest %s", version)
+	}
+
+	var manifest ociManifest
+	if err = json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return errors.Wrap(err, "failed to parse manifest")
+	}
+	layer, err := findTarballLayer(manifest)
+	if err != nil {
+		return
+	}
+	layerAlgorithm, layerDigest, err := splitDigest(layer.Digest)
+	if err != nil {
+		return
+	}
+
+	// Blobs may be large, so only bound the time it takes to connect and get the headers
+	blobClient := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 15 * time.Second,
+	}}
+	blobResp, err := downloader.do(blobClient, "GET", ref.url("blobs", layer.Digest))
+	if err != nil {
+		return errors.Wrap(err, "failed to get layer")
+	}
+	defer blobResp.Body.Close()
+	if blobResp.StatusCode >= 400 {
+		return fmt.Errorf("bad status code getting layer: %v", blobResp.StatusCode)
+	}
+
+	// The layer only replaces outputPath once it matches its digest
+	var numBytes int64
+	err = writeAtomic(outputPath, 0644, func(outFile *os.File) error {
+		layerHash := checksumAlgorithms[layerAlgorithm]()
+		var err error
+		numBytes, err = io.Copy(io.MultiWriter(outFile, layerHash), blobResp.Body)
+		if err != nil {
+			return errors.Wrap(err, "failed to write layer")
+		}
+		if fmt.Sprintf("%x", layerHash.Sum(nil)) != layerDigest {
+			return fmt.Errorf("layer does not match digest %s", layer.Digest)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	logrus.Debugf("Downloaded %d bytes layer %s", numBytes, layer.Digest)
+
+	return
+}
+
+// Download writes the tarball layer of the artifact that the reference currently points to to outputPath.
+func (downloader ociDownloader) Download(remotePath, outputPath string) error {
+	version, err := downloader.RemoteVersion(remotePath)
+	if err != nil {
+		return err
+	}
+
+	return downloader.DownloadVersion(remotePath, version, outputPath)
+}
+
+// RemoteChecksum always returns an empty checksum, OCI artifacts are versioned by manifest digest instead.
+func (downloader ociDownloader) RemoteChecksum(checksumURL string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	testOCIRepository = "infra/ansible"
+	testOCIUser       = "registry-user"
+	testOCIPass       = "registry-pass"
+	testOCIToken      = "registry-token"
+)
+
+// Register the below test suite
+func TestOCIDownloaderTestSuite(t *testing.T) {
+	suite.Run(t, new(OCIDownloaderTestSuite))
+}
+
+// OCIDownloaderTestSuite runs against a minimal in-process registry that implements
+// the pull side of the distribution protocol with token auth.
+type OCIDownloaderTestSuite struct {
+	suite.Suite
+	tmpDir     string
+	testServer *httptest.Server
+	registry   string
+	tags       map[string]string
+	manifests  map[string][]byte
+	blobs      map[string][]byte
+}
+
+func ociTestDigest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// push stores the content as a single layer artifact under the tag and returns its manifest digest
+func (s *OCIDownloaderTestSuite) push(tag string, content []byte) string {
+	layerDigest := ociTestDigest(content)
+	s.blobs[layerDigest] = content
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"layers": []ociDescriptor{{
+			MediaType:   "application/vnd.oci.image.layer.v1.tar+gzip",
+			Digest:      layerDigest,
+			Size:        int64(len(content)),
+			Annotations: map[string]string{ociTitleAnnotation: "bundle.tgz"},
+		}},
+	})
+	assert.Nil(s.T(), err)
+
+	digest := ociTestDigest(manifest)
+	s.manifests[digest] = manifest
+	s.tags[tag] = digest
+
+	return digest
+}
+
+func (s *OCIDownloaderTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.tags = map[string]string{}
+	s.manifests = map[string][]byte{}
+	s.blobs = map[string][]byte{}
+
+	s.testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			user, pass, ok := req.BasicAuth()
+			if !ok || user != testOCIUser || pass != testOCIPass {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]string{"token": testOCIToken})
+			return
+		}
+
+		if req.Header.Get("Authorization") != "Bearer "+testOCIToken {
+			rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, s.testServer.URL, testOCIRepository))
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		prefix := "/v2/" + testOCIRepository + "/"
+		switch {
+		case strings.HasPrefix(req.URL.Path, prefix+"manifests/"):
+			reference := strings.TrimPrefix(req.URL.Path, prefix+"manifests/")
+			if digest, ok := s.tags[reference]; ok {
+				reference = digest
+			}
+			manifest, ok := s.manifests[reference]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Content-Type", ociManifestMediaType)
+			rw.Header().Set("Docker-Content-Digest", reference)
+			rw.Write(manifest)
+		case strings.HasPrefix(req.URL.Path, prefix+"blobs/"):
+			blob, ok := s.blobs[strings.TrimPrefix(req.URL.Path, prefix+"blobs/")]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.Write(blob)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	s.registry = strings.TrimPrefix(s.testServer.URL, "http://")
+}
+
+func (s *OCIDownloaderTestSuite) TearDownTest() {
+	s.testServer.Close()
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *OCIDownloaderTestSuite) reference(tag string) string {
+	return fmt.Sprintf("http://%s/%s:%s", s.registry, testOCIRepository, tag)
+}
+
+func (s *OCIDownloaderTestSuite) TestParseOCIReference() {
+	ref, err := parseOCIReference("registry.example.com:5000/infra/ansible:production")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), ociReference{"https", "registry.example.com:5000", "infra/ansible", "production"}, *ref)
+
+	ref, err = parseOCIReference("http://localhost/ansible@sha256:abcd")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), ociReference{"http", "localhost", "ansible", "sha256:abcd"}, *ref)
+	assert.True(s.T(), ref.isDigest())
+
+	ref, err = parseOCIReference("localhost:5000/ansible")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "latest", ref.Reference)
+
+	_, err = parseOCIReference("ansible:latest")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *OCIDownloaderTestSuite) TestIdempotentDownload() {
+	good, err := ioutil.ReadFile("testdata/good.tgz")
+	assert.Nil(s.T(), err)
+	digest := s.push("production", good)
+
+	downloader := ociDownloader{username: testOCIUser, password: testOCIPass}
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+
+	version, err := idempotentVersionedDownload(downloader, s.reference("production"), localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), digest, version)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), good, text)
+
+	finfo, err := os.Stat(localFile)
+	assert.Nil(s.T(), err)
+
+	// Unchanged tag, nothing should be downloaded
+	version, err = idempotentVersionedDownload(downloader, s.reference("production"), localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), digest, version)
+
+	newFinfo, err := os.Stat(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), finfo.ModTime(), newFinfo.ModTime(), "modification time should not change")
+
+	// Moved tag
+	newDigest := s.push("production", testText)
+	version, err = idempotentVersionedDownload(downloader, s.reference("production"), localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), newDigest, version)
+
+	text, err = ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *OCIDownloaderTestSuite) TestDownloadByDigest() {
+	digest := s.push("production", testText)
+	s.push("production", testHashlessText)
+
+	downloader := ociDownloader{username: testOCIUser, password: testOCIPass}
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	reference := fmt.Sprintf("http://%s/%s@%s", s.registry, testOCIRepository, digest)
+
+	err := downloader.Download(reference, localFile)
+	assert.Nil(s.T(), err)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *OCIDownloaderTestSuite) TestDownloadCorruptLayer() {
+	s.push("production", testText)
+	s.blobs[ociTestDigest(testText)] = testHashlessText
+
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	assert.Nil(s.T(), ioutil.WriteFile(localFile, testHashlessText, 0644))
+
+	downloader := ociDownloader{username: testOCIUser, password: testOCIPass}
+	err := downloader.Download(s.reference("production"), localFile)
+	assert.NotNil(s.T(), err)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testHashlessText, text, "previous file should be kept when the layer does not match its digest")
+	files, err := ioutil.ReadDir(s.tmpDir)
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), files, 1, "unverified layer should be removed")
+}
+
+func (s *OCIDownloaderTestSuite) TestAuthFailure() {
+	s.push("production", testText)
+
+	_, err := ociDownloader{username: "wrong", password: "wrong"}.RemoteVersion(s.reference("production"))
+	assert.NotNil(s.T(), err)
+
+	_, err = ociDownloader{}.RemoteVersion(s.reference("missing"))
+	assert.NotNil(s.T(), err)
+}
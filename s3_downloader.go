@@ -2,31 +2,68 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"io/ioutil"
 	"path/filepath"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// Region used to sign requests to a custom endpoint when no region is configured
+	defaultS3EndpointRegion = "us-east-1"
+	// Session name of assumed roles, as shown in CloudTrail
+	s3RoleSessionName = "ansible-puller"
+)
+
 type s3Downloader struct {
 	downloader
-	manager *manager.Downloader
+	client      *s3.Client
+	manager     *manager.Downloader
+	credentials aws.CredentialsProvider
 }
 
+// Plain MD5 ETag of an object that was neither uploaded in parts nor encrypted with KMS or a customer key
+var s3MD5ETagRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
 type s3BucketObject struct {
 	Bucket string
 	File   string
 }
 
+// s3Options configures the connection to S3, or to an S3-compatible store such as MinIO or Ceph RGW
+type s3Options struct {
+	Region    string // Connection region, uses the aws-sdk-go-v2 default providers if not set
+	Endpoint  string // Custom endpoint URL, e.g. https://minio.example.com:9000
+	PathStyle bool   // Address buckets as endpoint/bucket/key instead of bucket.endpoint/key
+
+	Profile              string // Shared config profile to load instead of the default one
+	RoleARN              string // Role to assume for reading the object, e.g. in another account
+	ExternalID           string // External ID required by the trust policy of RoleARN
+	WebIdentityTokenFile string // OIDC token file to assume RoleARN with, instead of the base credentials
+}
+
 func parseS3ResourceFromARN(resource string) (*s3BucketObject, error) {
 	// Support for object ARNs
 	regexARN := regexp.MustCompile(`^arn:aws[\w-]*:s3:.*:.*:([^/]+)/(.+)$`)
@@ -41,69 +78,184 @@ func parseS3ResourceFromARN(resource string) (*s3BucketObject, error) {
 	return nil, errors.New(fmt.Sprintf("Not a valid S3 ARN: %s", resource))
 }
 
-func createS3Downloader(regionOverride string) (*s3Downloader, error) {
+func parseS3ResourceFromURI(resource string) (*s3BucketObject, error) {
+	// Support for s3://bucket/key URIs, as used by the AWS CLI
+	regexURI := regexp.MustCompile(`^s3://([^/]+)/(.+)$`)
+	matches := regexURI.FindStringSubmatch(resource)
+	if matches != nil {
+		return &s3BucketObject{
+			Bucket: matches[1],
+			File:   matches[2],
+		}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Not a valid S3 URI: %s", resource))
+}
+
+// parseS3Resource accepts either an object ARN or an s3:// URI
+func parseS3Resource(resource string) (*s3BucketObject, error) {
+	if strings.HasPrefix(resource, "s3://") {
+		return parseS3ResourceFromURI(resource)
+	}
+
+	return parseS3ResourceFromARN(resource)
+}
+
+func createS3Downloader(options s3Options) (*s3Downloader, error) {
 	ctx := context.TODO()
 	// A default connection region should be selected based on the EC2
 	// metadata by default. It ideally wouldn't matter because we're
 	// only accessing S3 which is globally namespaced but we have to
 	// consider connections orignating from China.
 	// https://github.com/aws/aws-sdk-go-v2/pull/523
-	var awsConfig aws.Config
-	var err error
-	if regionOverride != "" {
-		awsConfig, err = config.LoadDefaultConfig(ctx, config.WithRegion(regionOverride))
-	} else {
-		awsConfig, err = config.LoadDefaultConfig(ctx)
+	loadOptions := []func(*config.LoadOptions) error{}
+	if options.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(options.Region))
 	}
+	if options.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(options.Profile))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, loadOptions...)
 	if err != nil {
 		logrus.Warn("Error loading AWS config")
 		return nil, err
 	}
 
+	// The role is assumed with the credentials loaded above, or with the web identity token if given
+	switch {
+	case options.WebIdentityTokenFile != "":
+		if options.RoleARN == "" {
+			return nil, errors.New("a web identity token file requires a role ARN to assume")
+		}
+		awsConfig.Credentials = aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+			sts.NewFromConfig(awsConfig), options.RoleARN, stscreds.IdentityTokenFile(options.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = s3RoleSessionName
+			},
+		))
+	case options.RoleARN != "":
+		awsConfig.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(
+			sts.NewFromConfig(awsConfig), options.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) {
+				o.RoleSessionName = s3RoleSessionName
+				if options.ExternalID != "" {
+					o.ExternalID = aws.String(options.ExternalID)
+				}
+			},
+		))
+	}
+
 	// Sessions aren't required in the v2 of this SDK and
 	// EC2 role credentials are loaded automatically as per:
 	// https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/#iam-roles-for-amazon-ec2-instances
 
-	client := s3.NewFromConfig(awsConfig)
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if options.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(options.Endpoint)
+			// S3-compatible stores rarely care about the region, but requests must still be signed for one
+			if o.Region == "" {
+				o.Region = defaultS3EndpointRegion
+			}
+		}
+		o.UsePathStyle = options.PathStyle
+	})
 
 	manager := manager.NewDownloader(client)
 
 	return &s3Downloader{
-		manager: manager,
+		client:      client,
+		manager:     manager,
+		credentials: awsConfig.Credentials,
 	}, nil
 }
 
-func (downloader s3Downloader) Download(remotePath, outputPath string) (err error) {
+// SelfTest makes sure that credentials can be obtained and that the object can be read,
+// with an error that says which of the two failed.
+func (downloader s3Downloader) SelfTest(remotePath string) error {
 	ctx := context.TODO()
-	bucketObject, err := parseS3ResourceFromARN(remotePath)
+	bucketObject, err := parseS3Resource(remotePath)
 	if err != nil {
-		return
+		return err
 	}
 
-	file, err := os.Create(outputPath)
+	if downloader.credentials == nil {
+		return errors.New("no AWS credentials found, configure a profile, role or instance credentials")
+	}
+	credentials, err := downloader.credentials.Retrieve(ctx)
 	if err != nil {
-		logrus.Warnf("Could not create file '%s' for writing", outputPath)
-		return
+		return fmt.Errorf("unable to get AWS credentials: %w", err)
 	}
-	defer func() {
-		closeError := file.Close()
-		if err == nil {
-			err = closeError
+	logrus.Infof("Using AWS credentials from %s for %s", credentials.Source, remotePath)
+
+	_, err = downloader.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Key:    aws.String(bucketObject.File),
+	})
+	var responseError *smithyhttp.ResponseError
+	if errors.As(err, &responseError) {
+		switch responseError.HTTPStatusCode() {
+		case http.StatusForbidden:
+			return fmt.Errorf("access to %s denied with credentials from %s, check the IAM policy and bucket policy: %w", remotePath, credentials.Source, err)
+		case http.StatusNotFound:
+			return fmt.Errorf("object %s not found: %w", remotePath, err)
 		}
-	}()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", remotePath, err)
+	}
+
+	return nil
+}
+
+// Download fetches the object into outputPath. The object is written to a temporary file first,
+// so an interrupted download never leaves a truncated file at outputPath.
+func (downloader s3Downloader) Download(remotePath, outputPath string) error {
+	return downloader.download(remotePath, "", outputPath)
+}
+
+// download fetches the given version of the object, or the latest one if versionID is empty
+func (downloader s3Downloader) download(remotePath, versionID, outputPath string) error {
+	ctx := context.TODO()
+	bucketObject, err := parseS3Resource(remotePath)
+	if err != nil {
+		return err
+	}
 
 	parameters := &s3.GetObjectInput{
 		Bucket: aws.String(bucketObject.Bucket),
 		Key:    aws.String(bucketObject.File),
 	}
-	numBytes, err := downloader.manager.Download(ctx, file, parameters)
+	if versionID != "" {
+		parameters.VersionId = aws.String(versionID)
+	}
+	return writeAtomic(outputPath, 0644, func(file *os.File) error {
+		numBytes, err := downloader.manager.Download(ctx, file, parameters)
+		if err != nil {
+			logrus.Warnf("Could not download file '%s' from S3 bucket '%s': %v", bucketObject.File, bucketObject.Bucket, err)
+			return err
+		}
+		logrus.Debugf("Downloaded %d bytes from S3", numBytes)
+
+		return nil
+	})
+}
+
+// Open returns the contents of the object, for extracting it while it is downloaded
+func (downloader s3Downloader) Open(remotePath string) (io.ReadCloser, error) {
+	bucketObject, err := parseS3Resource(remotePath)
 	if err != nil {
-		logrus.Warnf("Could not download file '%s' from S3 bucket '%s': %v", bucketObject.File, bucketObject.Bucket, err)
-		return
+		return nil, err
 	}
-	logrus.Debugf("Downloaded %d bytes from S3", numBytes)
 
-	return
+	object, err := downloader.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Key:    aws.String(bucketObject.File),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return object.Body, nil
 }
 
 func (downloader s3Downloader) RemoteChecksum(checksumURL string) (string, error) {
@@ -114,15 +266,15 @@ func (downloader s3Downloader) RemoteChecksum(checksumURL string) (string, error
 		return "", err
 	}
 	defer os.RemoveAll(dir)
-	hashFile := filepath.Join(dir, "md5Hash")
+	hashFile := filepath.Join(dir, "checksum")
 
 	err = downloader.Download(checksumURL, hashFile)
 	if err != nil {
-		logrus.Infof("MD5 sum not reachable. %v", err)
+		logrus.Debugf("Checksum not reachable. %v", err)
 		return "", nil
 	}
 
-	logrus.Infof("Found MD5 sum at: %s", checksumURL)
+	logrus.Infof("Found checksum at: %s", checksumURL)
 
 	content, err := ioutil.ReadFile(hashFile)
 	if err != nil {
@@ -130,5 +282,174 @@ func (downloader s3Downloader) RemoteChecksum(checksumURL string) (string, error
 		return "", err
 	}
 
-	return string(content), nil
+	return parseChecksumFile(content)
+}
+
+// RemoteDigests looks up the digests of the object with a HeadObject request, so that no checksum
+// object has to be published next to it. Digests come from, in order of preference:
+//   - a digest in the user metadata, keyed by algorithm, e.g. `aws s3 cp --metadata sha256=<hex digest>`
+//   - the S3 SHA-256 additional checksum of the whole object
+//   - the ETag, which is the MD5 of the object unless it was uploaded in parts or encrypted with KMS or a customer key
+func (downloader s3Downloader) RemoteDigests(remotePath string) (map[string]string, error) {
+	ctx := context.TODO()
+	bucketObject, err := parseS3Resource(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SDK does not know about additional checksums yet, so the header is taken from the raw response
+	var checksumHeader string
+	captureChecksum := middleware.DeserializeMiddlewareFunc("CaptureChecksumSHA256", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		if response, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			checksumHeader = response.Header.Get("x-amz-checksum-sha256")
+		}
+		return out, metadata, err
+	})
+
+	output, err := downloader.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Key:    aws.String(bucketObject.File),
+	}, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions,
+			smithyhttp.AddHeaderValue("x-amz-checksum-mode", "ENABLED"),
+			func(stack *middleware.Stack) error {
+				return stack.Deserialize.Add(captureChecksum, middleware.After)
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+
+	// Multipart uploads get a checksum of the part checksums instead, which is not a digest of the object
+	checksum, err := base64.StdEncoding.DecodeString(checksumHeader)
+	if err == nil && len(checksum) == sha256.Size {
+		digests["sha256"] = hex.EncodeToString(checksum)
+	}
+
+	etag := strings.Trim(aws.ToString(output.ETag), `"`)
+	if s3MD5ETagRegex.MatchString(etag) && output.ServerSideEncryption != types.ServerSideEncryptionAwsKms && output.SSECustomerAlgorithm == nil {
+		digests["md5"] = etag
+	}
+
+	for algorithm := range checksumAlgorithms {
+		digest := strings.ToLower(strings.TrimSpace(output.Metadata[algorithm]))
+		if digest == "" {
+			continue
+		}
+		if err := ensureChecksumLength(digest, algorithm); err != nil {
+			logrus.Warnf("Ignoring %s digest in the metadata of %s: %v", algorithm, remotePath, err)
+			continue
+		}
+		digests[algorithm] = digest
+	}
+
+	return digests, nil
+}
+
+// s3VersionedDownloader pulls objects from a bucket with versioning enabled.
+// Objects are identified by their VersionId, so a previous version can be deployed without republishing it.
+type s3VersionedDownloader struct {
+	*s3Downloader
+	versionID string // Version to deploy instead of the latest one
+}
+
+// s3ObjectVersion describes one version of an object in a versioned bucket
+type s3ObjectVersion struct {
+	VersionID    string    `json:"version_id"`
+	LastModified time.Time `json:"last_modified"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	IsLatest     bool      `json:"is_latest"`
+}
+
+// RemoteVersion returns the pinned version, or the VersionId of the latest version of the object
+func (downloader s3VersionedDownloader) RemoteVersion(remotePath string) (string, error) {
+	if downloader.versionID != "" {
+		return downloader.versionID, nil
+	}
+
+	bucketObject, err := parseS3Resource(remotePath)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := downloader.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Key:    aws.String(bucketObject.File),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Objects that were stored before versioning was enabled have the "null" version
+	versionID := aws.ToString(output.VersionId)
+	if versionID == "" || versionID == "null" {
+		return "", fmt.Errorf("object %s has no version, is versioning enabled on bucket '%s'?", remotePath, bucketObject.Bucket)
+	}
+
+	return versionID, nil
+}
+
+func (downloader s3VersionedDownloader) DownloadVersion(remotePath, version, outputPath string) error {
+	return downloader.download(remotePath, version, outputPath)
+}
+
+// Versions lists the versions of the object, latest first
+func (downloader s3VersionedDownloader) Versions(remotePath string) ([]s3ObjectVersion, error) {
+	bucketObject, err := parseS3Resource(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []s3ObjectVersion{}
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucketObject.Bucket),
+		Prefix: aws.String(bucketObject.File),
+	}
+	for {
+		output, err := downloader.client.ListObjectVersions(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, version := range output.Versions {
+			// The prefix also matches other objects, e.g. the checksum or signature next to the tarball
+			if aws.ToString(version.Key) != bucketObject.File {
+				continue
+			}
+			versions = append(versions, s3ObjectVersion{
+				VersionID:    aws.ToString(version.VersionId),
+				LastModified: aws.ToTime(version.LastModified),
+				Size:         version.Size,
+				ETag:         strings.Trim(aws.ToString(version.ETag), `"`),
+				IsLatest:     version.IsLatest,
+			})
+		}
+
+		if !output.IsTruncated {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+
+	return versions, nil
+}
+
+// s3ObjectVersionDownloader downloads a specific version of objects, such as an older version of the signature
+type s3ObjectVersionDownloader struct {
+	s3VersionedDownloader
+	version string
+}
+
+func (downloader s3ObjectVersionDownloader) Download(remotePath, outputPath string) error {
+	return downloader.download(remotePath, downloader.version, outputPath)
 }
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
-	"testing"
 )
 
 var (
@@ -12,6 +27,13 @@ var (
 
 	testS3GoodURI = "s3://test_bucket/some/file_name"
 	testS3BadURI  = "s3://test_bucket"
+
+	testSha256 = "f6c1706ecdb494224b49d863788e3724b19275df13afbd676f34b3d6f9bdbe37"
+
+	testS3Bucket = "ansible"
+	testS3Key    = "infra/bundle.tgz"
+
+	testS3DeniedKey = "denied-access-key" // Access key that the test store refuses
 )
 
 // Register the below test suite
@@ -19,8 +41,128 @@ func TestDownloadS3TestSuite(t *testing.T) {
 	suite.Run(t, new(S3DownloaderTestSuite))
 }
 
+// S3DownloaderTestSuite runs against a minimal in-process S3-compatible store that only supports path-style requests
 type S3DownloaderTestSuite struct {
 	suite.Suite
+	tmpDir     string
+	testServer *httptest.Server
+	objects    map[string][]byte
+	headers    map[string]map[string]string // Response headers per object, e.g. the ETag
+	gets       int                          // Number of GET requests for objects
+	versions   map[string][]testS3Version   // Versions of objects in a versioned bucket, oldest first
+}
+
+type testS3Version struct {
+	id       string
+	content  []byte
+	modified time.Time
+}
+
+// putVersion stores a new version of the object, returning its VersionId
+func (s *S3DownloaderTestSuite) putVersion(path string, content []byte) string {
+	id := fmt.Sprintf("version-%d", len(s.versions[path])+1)
+	s.versions[path] = append(s.versions[path], testS3Version{id, content, time.Date(2020, 1, len(s.versions[path])+1, 0, 0, 0, 0, time.UTC)})
+	return id
+}
+
+// listVersions answers a ListObjectVersions request
+func (s *S3DownloaderTestSuite) listVersions(rw http.ResponseWriter, req *http.Request) {
+	type version struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified string
+		Size         int
+	}
+	result := struct {
+		XMLName  xml.Name  `xml:"ListVersionsResult"`
+		Versions []version `xml:"Version"`
+	}{}
+
+	bucket := strings.Trim(req.URL.Path, "/")
+	for path, versions := range s.versions {
+		key := strings.TrimPrefix(path, bucket+"/")
+		if !strings.HasPrefix(key, req.URL.Query().Get("prefix")) {
+			continue
+		}
+		for i, v := range versions {
+			result.Versions = append(result.Versions, version{key, v.id, i == len(versions)-1, v.modified.Format(time.RFC3339), len(v.content)})
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(rw).Encode(result)
+}
+
+func (s *S3DownloaderTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	// Static credentials, so that the tests never reach for the instance metadata service
+	s.T().Setenv("AWS_ACCESS_KEY_ID", "test-access-key")
+	s.T().Setenv("AWS_SECRET_ACCESS_KEY", "test-secret-key")
+	s.T().Setenv("AWS_CONFIG_FILE", os.DevNull)
+	s.T().Setenv("AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	s.T().Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	s.objects = map[string][]byte{}
+	s.headers = map[string]map[string]string{}
+	s.gets = 0
+	s.versions = map[string][]testS3Version{}
+	s.testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authorization := req.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256") || strings.Contains(authorization, "Credential="+testS3DeniedKey+"/") {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if _, ok := req.URL.Query()["versions"]; ok {
+			s.listVersions(rw, req)
+			return
+		}
+
+		path := strings.TrimPrefix(req.URL.Path, "/")
+		object, ok := s.objects[path]
+		if versions := s.versions[path]; len(versions) > 0 {
+			version := versions[len(versions)-1]
+			ok = true
+			if versionID := req.URL.Query().Get("versionId"); versionID != "" {
+				ok = false
+				for _, v := range versions {
+					if v.id == versionID {
+						version, ok = v, true
+					}
+				}
+			}
+			object = version.content
+			rw.Header().Set("x-amz-version-id", version.id)
+		}
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodGet {
+			s.gets++
+		}
+		for name, value := range s.headers[path] {
+			if name != "x-amz-checksum-sha256" || req.Header.Get("x-amz-checksum-mode") == "ENABLED" {
+				rw.Header().Set(name, value)
+			}
+		}
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(object))
+	}))
+}
+
+func (s *S3DownloaderTestSuite) TearDownTest() {
+	s.testServer.Close()
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *S3DownloaderTestSuite) downloader() *s3Downloader {
+	downloader, err := createS3Downloader(s3Options{Endpoint: s.testServer.URL, PathStyle: true})
+	assert.Nil(s.T(), err)
+	return downloader
 }
 
 func (s *S3DownloaderTestSuite) TestParseS3ResourceGoodARN() {
@@ -38,3 +180,230 @@ func (s *S3DownloaderTestSuite) TestParseS3ResourceBadARN() {
 	assert.Nil(s.T(), bucketObject)
 	assert.NotNil(s.T(), err)
 }
+
+func (s *S3DownloaderTestSuite) TestParseS3ResourceGoodURI() {
+	bucketObject, err := parseS3Resource(testS3GoodURI)
+
+	assert.Nil(s.T(), err)
+	assert.NotNil(s.T(), bucketObject)
+	assert.Equal(s.T(), "test_bucket", bucketObject.Bucket)
+	assert.Equal(s.T(), "some/file_name", bucketObject.File)
+
+	bucketObject, err = parseS3Resource(testS3GoodARN)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "some/file_name", bucketObject.File, "ARNs should still be accepted")
+}
+
+func (s *S3DownloaderTestSuite) TestParseS3ResourceBadURI() {
+	bucketObject, err := parseS3Resource(testS3BadURI)
+
+	assert.Nil(s.T(), bucketObject)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *S3DownloaderTestSuite) TestIdempotentDownloadCustomEndpoint() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.objects[testS3Bucket+"/"+testS3Key+".md5"] = []byte(testMD5)
+
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	err := idempotentFileDownload(s.downloader(), "s3://"+testS3Bucket+"/"+testS3Key, testEmptyChecksumUrl, testDefaultChecksumAlgorithm, localFile)
+	assert.Nil(s.T(), err)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+}
+
+func (s *S3DownloaderTestSuite) TestDownloadMissingObject() {
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	err := s.downloader().Download("s3://"+testS3Bucket+"/missing.tgz", localFile)
+	assert.NotNil(s.T(), err)
+
+	_, err = os.Stat(localFile)
+	assert.True(s.T(), os.IsNotExist(err), "failed download must not leave a file behind")
+}
+
+func (s *S3DownloaderTestSuite) TestSelfTest() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+
+	err := s.downloader().SelfTest("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.Nil(s.T(), err)
+
+	err = s.downloader().SelfTest("s3://" + testS3Bucket + "/missing.tgz")
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "not found")
+	assert.Equal(s.T(), 0, s.gets, "self-test must not download the object")
+}
+
+func (s *S3DownloaderTestSuite) TestSelfTestAccessDenied() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.T().Setenv("AWS_ACCESS_KEY_ID", testS3DeniedKey)
+
+	err := s.downloader().SelfTest("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "access to s3://"+testS3Bucket+"/"+testS3Key+" denied")
+}
+
+func (s *S3DownloaderTestSuite) TestSelfTestWebIdentity() {
+	_, err := createS3Downloader(s3Options{Endpoint: s.testServer.URL, WebIdentityTokenFile: filepath.Join(s.tmpDir, "token")})
+	assert.NotNil(s.T(), err, "web identity requires a role to assume")
+
+	downloader, err := createS3Downloader(s3Options{
+		Endpoint:             s.testServer.URL,
+		PathStyle:            true,
+		RoleARN:              "arn:aws:iam::123456789012:role/ansible-puller",
+		WebIdentityTokenFile: filepath.Join(s.tmpDir, "missing-token"),
+	})
+	assert.Nil(s.T(), err)
+
+	err = downloader.SelfTest("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "unable to get AWS credentials")
+}
+
+// pullTwice downloads the test object twice and returns the number of times it was fetched
+func (s *S3DownloaderTestSuite) pullTwice(checksumAlgorithm string) int {
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	for i := 0; i < 2; i++ {
+		err := idempotentFileDownload(s.downloader(), "s3://"+testS3Bucket+"/"+testS3Key, testEmptyChecksumUrl, checksumAlgorithm, localFile)
+		assert.Nil(s.T(), err)
+	}
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+
+	return s.gets
+}
+
+func (s *S3DownloaderTestSuite) TestRemoteDigestsETag() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.headers[testS3Bucket+"/"+testS3Key] = map[string]string{"ETag": `"` + testMD5 + `"`}
+
+	assert.Equal(s.T(), 1, s.pullTwice(testDefaultChecksumAlgorithm), "unchanged object should only be fetched once, without a checksum object")
+}
+
+func (s *S3DownloaderTestSuite) TestRemoteDigestsAdditionalChecksum() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.headers[testS3Bucket+"/"+testS3Key] = map[string]string{
+		"ETag":                  `"0123456789abcdef0123456789abcdef-2"`,
+		"x-amz-checksum-sha256": "9sFwbs20lCJLSdhjeI43JLGSdd8Tr71nbzSz1vm9vjc=",
+	}
+
+	digests, err := s.downloader().RemoteDigests("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), map[string]string{"sha256": testSha256}, digests, "multipart ETag is not an MD5")
+
+	assert.Equal(s.T(), 1, s.pullTwice(testDefaultChecksumAlgorithm))
+}
+
+func (s *S3DownloaderTestSuite) TestRemoteDigestsMetadata() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.headers[testS3Bucket+"/"+testS3Key] = map[string]string{
+		"ETag":              `"` + testMD5 + `"`,
+		"x-amz-meta-sha256": strings.ToUpper(testSha256),
+	}
+
+	digests, err := s.downloader().RemoteDigests("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), map[string]string{"md5": testMD5, "sha256": testSha256}, digests)
+
+	assert.Equal(s.T(), 1, s.pullTwice("sha256"))
+}
+
+func (s *S3DownloaderTestSuite) TestRemoteDigestsKMSEncrypted() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+	s.headers[testS3Bucket+"/"+testS3Key] = map[string]string{
+		"ETag":                         `"0123456789abcdef0123456789abcdef"`,
+		"x-amz-server-side-encryption": "aws:kms",
+	}
+
+	digests, err := s.downloader().RemoteDigests("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), digests, "ETag of a KMS encrypted object is not an MD5")
+
+	assert.Equal(s.T(), 2, s.pullTwice(testDefaultChecksumAlgorithm), "without a digest the object is fetched every time")
+}
+
+func (s *S3DownloaderTestSuite) TestVersionedDownload() {
+	path := testS3Bucket + "/" + testS3Key
+	oldVersion := s.putVersion(path, testHashlessText)
+	newVersion := s.putVersion(path, testText)
+
+	client := s.downloader()
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+
+	version, err := idempotentVersionedDownload(s3VersionedDownloader{client, ""}, "s3://"+path, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), newVersion, version)
+
+	text, err := ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testText, text)
+
+	// Unchanged version, nothing should be downloaded
+	_, err = idempotentVersionedDownload(s3VersionedDownloader{client, ""}, "s3://"+path, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, s.gets)
+
+	// Roll back to the pinned version
+	version, err = idempotentVersionedDownload(s3VersionedDownloader{client, oldVersion}, "s3://"+path, localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), oldVersion, version)
+
+	text, err = ioutil.ReadFile(localFile)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), testHashlessText, text)
+
+	_, err = idempotentVersionedDownload(s3VersionedDownloader{client, "missing"}, "s3://"+path, localFile)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *S3DownloaderTestSuite) TestPinnedVersionSignature() {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(s.T(), err)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	assert.Nil(s.T(), err)
+	keyFile := filepath.Join(s.tmpDir, "key.pem")
+	assert.Nil(s.T(), ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	// Every version of the tarball is published along with a new version of its signature
+	path := testS3Bucket + "/" + testS3Key
+	oldVersion := s.putVersion(path, testHashlessText)
+	s.putVersion(path+".sig", ed25519.Sign(private, testHashlessText))
+	s.putVersion(path, testText)
+	s.putVersion(path+".sig", ed25519.Sign(private, testText))
+	unsignedVersion := s.putVersion(path, testSignedText)
+
+	source := sourceConfig{S3URI: "s3://" + path, S3Endpoint: s.testServer.URL, S3PathStyle: true, S3VersionID: oldVersion}
+	localFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	version, err := source.pull(localFile, []string{keyFile})
+	assert.Nil(s.T(), err, "pinned version should verify against its own signature")
+	assert.Equal(s.T(), oldVersion, version)
+
+	source.S3VersionID = unsignedVersion
+	_, err = source.pull(localFile, []string{keyFile})
+	assert.NotNil(s.T(), err, "a version without a matching signature must fail verification")
+}
+
+func (s *S3DownloaderTestSuite) TestVersions() {
+	path := testS3Bucket + "/" + testS3Key
+	oldVersion := s.putVersion(path, testHashlessText)
+	newVersion := s.putVersion(path, testText)
+	s.putVersion(path+".md5", []byte(testMD5))
+
+	versions, err := s3VersionedDownloader{s.downloader(), ""}.Versions("s3://" + path)
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), versions, 2, "versions of other objects with the same prefix should be left out")
+	assert.Equal(s.T(), newVersion, versions[0].VersionID)
+	assert.True(s.T(), versions[0].IsLatest)
+	assert.Equal(s.T(), oldVersion, versions[1].VersionID)
+	assert.Equal(s.T(), int64(len(testHashlessText)), versions[1].Size)
+}
+
+func (s *S3DownloaderTestSuite) TestRemoteVersionUnversionedBucket() {
+	s.objects[testS3Bucket+"/"+testS3Key] = testText
+
+	_, err := s3VersionedDownloader{s.downloader(), ""}.RemoteVersion("s3://" + testS3Bucket + "/" + testS3Key)
+	assert.NotNil(s.T(), err)
+}
@@ -0,0 +1,75 @@
+// Credentials that can be rotated without restarting the daemon
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// secret is a credential given inline, or read from a file or an environment variable every time it is used,
+// so that a secret rotation agent can update it while the daemon is running.
+//
+// If more than one is given, the inline value wins over the file, and the file over the environment variable.
+type secret struct {
+	Value string
+	File  string
+	Env   string
+}
+
+func (s secret) isSet() bool {
+	return s.Value != "" || s.File != "" || s.Env != ""
+}
+
+// Get returns the current value of the secret, or "" if it is not set
+func (s secret) Get() (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.File != "":
+		data, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to read secret file")
+		}
+		// Secret files usually end with a newline, which is never part of the secret
+		value := strings.TrimSpace(string(data))
+		if value == "" {
+			return "", fmt.Errorf("secret file %s is empty", s.File)
+		}
+		return value, nil
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok || value == "" {
+			return "", fmt.Errorf("secret environment variable %s is not set", s.Env)
+		}
+		return value, nil
+	}
+
+	return "", nil
+}
+
+// secretMap combines inline values, files and environment variables keyed by the same names (e.g. HTTP header names)
+func secretMap(values, files, envs map[string]string) map[string]secret {
+	secrets := map[string]secret{}
+	for name, value := range values {
+		s := secrets[name]
+		s.Value = value
+		secrets[name] = s
+	}
+	for name, file := range files {
+		s := secrets[name]
+		s.File = file
+		secrets[name] = s
+	}
+	for name, env := range envs {
+		s := secrets[name]
+		s.Env = env
+		secrets[name] = s
+	}
+
+	return secrets
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretPrecedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "secret")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("from-file\n")
+	file.Close()
+
+	os.Setenv("ANSIBLE_PULLER_TEST_SECRET", "from-env")
+	defer os.Unsetenv("ANSIBLE_PULLER_TEST_SECRET")
+
+	value, err := secret{Value: "inline", File: file.Name(), Env: "ANSIBLE_PULLER_TEST_SECRET"}.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "inline", value)
+
+	value, err = secret{File: file.Name(), Env: "ANSIBLE_PULLER_TEST_SECRET"}.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file", value, "trailing newline should be trimmed")
+
+	value, err = secret{Env: "ANSIBLE_PULLER_TEST_SECRET"}.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", value)
+
+	value, err = secret{}.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "", value)
+}
+
+func TestSecretMissing(t *testing.T) {
+	_, err := secret{File: "/nonexistent/secret"}.Get()
+	assert.NotNil(t, err)
+
+	_, err = secret{Env: "ANSIBLE_PULLER_TEST_UNSET_SECRET"}.Get()
+	assert.NotNil(t, err)
+}
+
+func TestSecretMap(t *testing.T) {
+	secrets := secretMap(
+		map[string]string{"X-Static": "value"},
+		map[string]string{"X-Api-Key": "/run/secrets/key"},
+		map[string]string{"X-Api-Key": "API_KEY"},
+	)
+	assert.Equal(t, map[string]secret{
+		"X-Static":  {Value: "value"},
+		"X-Api-Key": {File: "/run/secrets/key", Env: "API_KEY"},
+	}, secrets)
+}
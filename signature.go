@@ -0,0 +1,197 @@
+// Functions for verifying detached signatures of the Ansible tarball
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// parsePublicKeys reads all trusted public keys from the contents of a key file.
+//
+// Supported formats are PEM-encoded PKIX public keys ("-----BEGIN PUBLIC KEY-----"), as produced by
+// `openssl pkey -pubout` for Ed25519 keys or `cosign generate-key-pair` for ECDSA keys, and lines holding
+// a base64-encoded raw 32 byte Ed25519 public key. Empty lines and lines starting with '#' are ignored.
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse PEM public key")
+		}
+
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T, must be Ed25519 or ECDSA", key)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode base64 public key")
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("raw Ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+		}
+
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+
+	return keys, scanner.Err()
+}
+
+// loadTrustedKeys reads and parses all of the given public key files.
+func loadTrustedKeys(keyFiles []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for _, keyFile := range keyFiles {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read public key file %s", keyFile)
+		}
+
+		fileKeys, err := parsePublicKeys(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse public key file %s", keyFile)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no trusted public keys found")
+	}
+
+	return keys, nil
+}
+
+// decodeSignature accepts either a raw binary signature or a base64-encoded one
+// (as produced by `cosign sign-blob` or `openssl pkeyutl ... | base64`).
+func decodeSignature(signature []byte) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return signature
+	}
+
+	return decoded
+}
+
+// verifySignature checks that signature is a valid signature of content by any of the trusted keys.
+//
+// Ed25519 signatures are made over the content itself, ECDSA signatures over its SHA-256 digest.
+func verifySignature(content, signature []byte, keys []crypto.PublicKey) error {
+	signature = decodeSignature(signature)
+	digest := sha256.Sum256(content)
+
+	for _, key := range keys {
+		switch k := key.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, content, signature) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, digest[:], signature) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("signature does not match any trusted public key")
+}
+
+// verifyRemoteSignature fetches the detached signature at signatureURL with the given downloader
+// and checks it against the local file at path.
+func verifyRemoteSignature(downloader downloader, signatureURL, path string, keyFiles []string) error {
+	keys, err := loadTrustedKeys(keyFiles)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary dir for signature")
+	}
+	defer os.RemoveAll(dir)
+	signatureFile := filepath.Join(dir, "signature")
+
+	logrus.Debugf("Fetching signature from %s", signatureURL)
+	if err := downloader.Download(signatureURL, signatureFile); err != nil {
+		return errors.Wrap(err, "unable to download signature")
+	}
+
+	signature, err := ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to read signature")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to read file to verify")
+	}
+
+	if err := verifySignature(content, signature, keys); err != nil {
+		return err
+	}
+	logrus.Infof("Verified signature of %s", path)
+
+	return nil
+}
+
+// verifyS3VersionSignature checks a version of a versioned S3 object against the versions of its signature object.
+//
+// The latest signature only matches the latest version of the object, so when an older version is deployed,
+// its signature is an older version of the signature object. Any version that verifies with a trusted key will do,
+// they are tried latest first.
+func verifyS3VersionSignature(downloader s3VersionedDownloader, signatureURL, path string, keyFiles []string) error {
+	versions, err := downloader.Versions(signatureURL)
+	if err != nil {
+		return errors.Wrap(err, "unable to list signature versions")
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("no signature found at %s", signatureURL)
+	}
+
+	for _, version := range versions {
+		err = verifyRemoteSignature(s3ObjectVersionDownloader{downloader, version.VersionID}, signatureURL, path, keyFiles)
+		if err == nil {
+			return nil
+		}
+		logrus.Debugf("Signature version %s does not match: %v", version.VersionID, err)
+	}
+
+	return err
+}
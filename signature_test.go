@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+var testSignedText = []byte("Duis aute irure dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur.")
+
+// Register the below test suite
+func TestSignatureTestSuite(t *testing.T) {
+	suite.Run(t, new(SignatureTestSuite))
+}
+
+type SignatureTestSuite struct {
+	suite.Suite
+	tmpDir     string
+	edPublic   ed25519.PublicKey
+	edPrivate  ed25519.PrivateKey
+	ecdsaKey   *ecdsa.PrivateKey
+	signedFile string
+}
+
+func (s *SignatureTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.edPublic, s.edPrivate, err = ed25519.GenerateKey(rand.Reader)
+	assert.Nil(s.T(), err)
+
+	s.ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(s.T(), err)
+
+	s.signedFile = filepath.Join(s.tmpDir, "bundle.tgz")
+	assert.Nil(s.T(), ioutil.WriteFile(s.signedFile, testSignedText, 0600))
+}
+
+func (s *SignatureTestSuite) TearDownTest() {
+	os.RemoveAll(s.tmpDir)
+}
+
+func (s *SignatureTestSuite) writePEMKey(name string, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.Nil(s.T(), err)
+
+	path := filepath.Join(s.tmpDir, name)
+	assert.Nil(s.T(), ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	return path
+}
+
+func (s *SignatureTestSuite) TestParsePublicKeys() {
+	pemKey := s.writePEMKey("ed25519.pem", s.edPublic)
+	ecdsaKey := s.writePEMKey("ecdsa.pem", &s.ecdsaKey.PublicKey)
+
+	rawKey := filepath.Join(s.tmpDir, "raw.pub")
+	assert.Nil(s.T(), ioutil.WriteFile(rawKey, []byte("# deploy key\n"+base64.StdEncoding.EncodeToString(s.edPublic)+"\n"), 0600))
+
+	keys, err := loadTrustedKeys([]string{pemKey, ecdsaKey, rawKey})
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), keys, 3)
+}
+
+func (s *SignatureTestSuite) TestParsePublicKeysInvalid() {
+	_, err := parsePublicKeys([]byte("not a key"))
+	assert.NotNil(s.T(), err)
+
+	_, err = parsePublicKeys([]byte(base64.StdEncoding.EncodeToString([]byte("too short"))))
+	assert.NotNil(s.T(), err)
+
+	_, err = loadTrustedKeys([]string{})
+	assert.NotNil(s.T(), err)
+}
+
+func (s *SignatureTestSuite) TestVerifyEd25519Signature() {
+	signature := ed25519.Sign(s.edPrivate, testSignedText)
+	keys := []crypto.PublicKey{s.edPublic}
+
+	assert.Nil(s.T(), verifySignature(testSignedText, signature, keys))
+	assert.Nil(s.T(), verifySignature(testSignedText, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), keys))
+	assert.NotNil(s.T(), verifySignature([]byte("tampered"), signature, keys))
+}
+
+func (s *SignatureTestSuite) TestVerifyECDSASignature() {
+	digest := sha256.Sum256(testSignedText)
+	signature, err := ecdsa.SignASN1(rand.Reader, s.ecdsaKey, digest[:])
+	assert.Nil(s.T(), err)
+
+	keys := []crypto.PublicKey{s.edPublic, &s.ecdsaKey.PublicKey}
+	assert.Nil(s.T(), verifySignature(testSignedText, []byte(base64.StdEncoding.EncodeToString(signature)), keys))
+	assert.NotNil(s.T(), verifySignature([]byte("tampered"), signature, keys))
+}
+
+func (s *SignatureTestSuite) TestVerifyRemoteSignature() {
+	goodSignature := ed25519.Sign(s.edPrivate, testSignedText)
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(s.T(), err)
+	badSignature := ed25519.Sign(otherPrivate, testSignedText)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/good.tgz.sig":
+			rw.Write(goodSignature)
+		case "/bad.tgz.sig":
+			rw.Write(badSignature)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	keyFile := s.writePEMKey("ed25519.pem", s.edPublic)
+
+	err = verifyRemoteSignature(httpDownloader{}, server.URL+"/good.tgz.sig", s.signedFile, []string{keyFile})
+	assert.Nil(s.T(), err)
+
+	err = verifyRemoteSignature(httpDownloader{}, server.URL+"/bad.tgz.sig", s.signedFile, []string{keyFile})
+	assert.NotNil(s.T(), err)
+
+	err = verifyRemoteSignature(httpDownloader{}, server.URL+"/missing.tgz.sig", s.signedFile, []string{keyFile})
+	assert.NotNil(s.T(), err, "a missing signature must fail verification")
+}
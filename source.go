@@ -0,0 +1,438 @@
+// Collection of methods and types for choosing where to pull the Ansible repository from
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// sourceConfig describes one remote location of the Ansible repository, along with its credentials.
+//
+// The keys are the same as the top-level config keys. Settings that are not given for a source,
+// such as credentials or the checksum algorithm, are inherited from the top-level config.
+type sourceConfig struct {
+	Name              string            `mapstructure:"name"` // Name used in logs and metrics, defaults to the resource
+	HTTPURL           string            `mapstructure:"http-url"`
+	HTTPProto         string            `mapstructure:"http-proto"`
+	HTTPUser          string            `mapstructure:"http-user"`
+	HTTPPass          string            `mapstructure:"http-pass"`
+	HTTPPassFile      string            `mapstructure:"http-pass-file"`
+	HTTPPassEnv       string            `mapstructure:"http-pass-env"`
+	HTTPToken         string            `mapstructure:"http-token"`
+	HTTPTokenFile     string            `mapstructure:"http-token-file"`
+	HTTPTokenEnv      string            `mapstructure:"http-token-env"`
+	HTTPHeaders       map[string]string `mapstructure:"http-headers"`
+	HTTPHeaderFiles   map[string]string `mapstructure:"http-header-files"`
+	HTTPHeaderEnvs    map[string]string `mapstructure:"http-header-envs"`
+	HTTPChecksumURL   string            `mapstructure:"http-checksum-url"`
+	HTTPCAFile        string            `mapstructure:"http-ca-file"`
+	HTTPClientCert    string            `mapstructure:"http-client-cert"`
+	HTTPClientKey     string            `mapstructure:"http-client-key"`
+	HTTPTLSMinVersion string            `mapstructure:"http-tls-min-version"`
+	ChecksumAlgorithm string            `mapstructure:"checksum-algorithm"`
+	S3ARN             string            `mapstructure:"s3-arn"`
+	S3URI             string            `mapstructure:"s3-uri"`
+	S3Bucket          string            `mapstructure:"s3-bucket"`
+	S3Key             string            `mapstructure:"s3-key"`
+	S3ConnRegion      string            `mapstructure:"s3-conn-region"`
+	S3Endpoint        string            `mapstructure:"s3-endpoint"`
+	S3Profile         string            `mapstructure:"s3-profile"`
+	S3RoleARN         string            `mapstructure:"s3-role-arn"`
+	S3ExternalID      string            `mapstructure:"s3-external-id"`
+	S3WebIdentityFile string            `mapstructure:"s3-web-identity-token-file"`
+	S3PathStyle       bool              `mapstructure:"s3-path-style"`
+	S3Versioned       bool              `mapstructure:"s3-versioned"`
+	S3VersionID       string            `mapstructure:"s3-version-id"`
+	GitURL            string            `mapstructure:"git-url"`
+	GitRef            string            `mapstructure:"git-ref"`
+	GitCacheDir       string            `mapstructure:"git-cache-dir"`
+	OCIRef            string            `mapstructure:"oci-ref"`
+	OCIUser           string            `mapstructure:"oci-user"`
+	OCIPass           string            `mapstructure:"oci-pass"`
+	SignatureURL      string            `mapstructure:"signature-url"`
+}
+
+// loadSources returns the ordered list of sources to try.
+//
+// Sources come from the 'sources' list in the config file. Without one, the top-level
+// 'http-url', 's3-arn', 's3-uri', 's3-bucket'/'s3-key', 'git-url' or 'oci-ref' defines a single source.
+func loadSources() ([]sourceConfig, error) {
+	var sources []sourceConfig
+	if err := viper.UnmarshalKey("sources", &sources); err != nil {
+		return nil, errors.Wrap(err, "unable to parse 'sources'")
+	}
+
+	if len(sources) == 0 {
+		sources = append(sources, sourceConfig{
+			HTTPURL:         viper.GetString("http-url"),
+			HTTPChecksumURL: viper.GetString("http-checksum-url"),
+			S3ARN:           viper.GetString("s3-arn"),
+			S3URI:           viper.GetString("s3-uri"),
+			S3Bucket:        viper.GetString("s3-bucket"),
+			S3Key:           viper.GetString("s3-key"),
+			S3VersionID:     viper.GetString("s3-version-id"),
+			GitURL:          viper.GetString("git-url"),
+			OCIRef:          viper.GetString("oci-ref"),
+			SignatureURL:    viper.GetString("signature-url"),
+		})
+	}
+
+	for i := range sources {
+		sources[i].inheritDefaults()
+		if err := sources[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid source #%d", i+1)
+		}
+	}
+
+	return sources, nil
+}
+
+// inheritDefaults fills settings that were not given for the source from the top-level config
+func (s *sourceConfig) inheritDefaults() {
+	inherit := func(field *string, key string) {
+		if *field == "" {
+			*field = viper.GetString(key)
+		}
+	}
+
+	inherit(&s.HTTPProto, "http-proto")
+	inherit(&s.HTTPUser, "http-user")
+	// A secret given for the source in any form replaces the top-level one entirely
+	inheritSecret := func(value, file, env *string, key string) {
+		if *value == "" && *file == "" && *env == "" {
+			inherit(value, key)
+			inherit(file, key+"-file")
+			inherit(env, key+"-env")
+		}
+	}
+	inheritSecret(&s.HTTPPass, &s.HTTPPassFile, &s.HTTPPassEnv, "http-pass")
+	inheritSecret(&s.HTTPToken, &s.HTTPTokenFile, &s.HTTPTokenEnv, "http-token")
+	if s.HTTPHeaders == nil && s.HTTPHeaderFiles == nil && s.HTTPHeaderEnvs == nil {
+		s.HTTPHeaders = viper.GetStringMapString("http-headers")
+		s.HTTPHeaderFiles = viper.GetStringMapString("http-header-files")
+		s.HTTPHeaderEnvs = viper.GetStringMapString("http-header-envs")
+	}
+	inherit(&s.HTTPCAFile, "http-ca-file")
+	inherit(&s.HTTPClientCert, "http-client-cert")
+	inherit(&s.HTTPClientKey, "http-client-key")
+	inherit(&s.HTTPTLSMinVersion, "http-tls-min-version")
+	inherit(&s.ChecksumAlgorithm, "checksum-algorithm")
+	inherit(&s.S3ConnRegion, "s3-conn-region")
+	inherit(&s.S3Endpoint, "s3-endpoint")
+	inherit(&s.S3Profile, "s3-profile")
+	inherit(&s.S3RoleARN, "s3-role-arn")
+	inherit(&s.S3ExternalID, "s3-external-id")
+	inherit(&s.S3WebIdentityFile, "s3-web-identity-token-file")
+	s.S3PathStyle = s.S3PathStyle || viper.GetBool("s3-path-style")
+	s.S3Versioned = s.S3Versioned || viper.GetBool("s3-versioned")
+	inherit(&s.GitRef, "git-ref")
+	inherit(&s.GitCacheDir, "git-cache-dir")
+	inherit(&s.OCIUser, "oci-user")
+	inherit(&s.OCIPass, "oci-pass")
+}
+
+// validate makes sure exactly one remote resource is defined
+func (s sourceConfig) validate() error {
+	definedResources := 0
+	for _, resource := range []string{s.HTTPURL, s.S3ARN, s.S3URI, s.S3Bucket, s.GitURL, s.OCIRef} {
+		if resource != "" {
+			definedResources++
+		}
+	}
+
+	if definedResources != 1 {
+		return errors.New("exactly one remote resource must be specified. Choose one 'http-url', 's3-arn', 's3-uri', 's3-bucket', 'git-url' or 'oci-ref'")
+	}
+
+	if (s.S3Bucket == "") != (s.S3Key == "") {
+		return errors.New("'s3-bucket' and 's3-key' must be given together")
+	}
+	if resource := s.s3Resource(); resource != "" {
+		if _, err := parseS3Resource(resource); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// s3Resource returns the S3 object of the source as an ARN or s3:// URI, or "" if it is not an S3 source
+func (s sourceConfig) s3Resource() string {
+	switch {
+	case s.S3ARN != "":
+		return s.S3ARN
+	case s.S3URI != "":
+		return s.S3URI
+	case s.S3Bucket != "":
+		return fmt.Sprintf("s3://%s/%s", s.S3Bucket, strings.TrimPrefix(s.S3Key, "/"))
+	}
+
+	return ""
+}
+
+// label identifies the source in logs and metrics
+func (s sourceConfig) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	for _, resource := range []string{s.HTTPURL, s.s3Resource(), s.GitURL, s.OCIRef} {
+		if resource != "" {
+			return resource
+		}
+	}
+
+	return ""
+}
+
+// pinS3Version makes the S3 sources named name, or all S3 sources if name is empty, deploy the given object version
+func pinS3Version(sources []sourceConfig, name, versionID string) error {
+	pinned := 0
+	for i := range sources {
+		if sources[i].s3Resource() == "" || (name != "" && sources[i].label() != name) {
+			continue
+		}
+		sources[i].S3VersionID = versionID
+		pinned++
+	}
+
+	if pinned == 0 {
+		return fmt.Errorf("no S3 source named '%s'", name)
+	}
+
+	return nil
+}
+
+// findS3Source returns the S3 source named name, or the first S3 source if name is empty
+func findS3Source(sources []sourceConfig, name string) (sourceConfig, error) {
+	for _, source := range sources {
+		if source.s3Resource() != "" && (name == "" || source.label() == name) {
+			return source, nil
+		}
+	}
+
+	return sourceConfig{}, fmt.Errorf("no S3 source named '%s'", name)
+}
+
+// newDownloader creates the downloader for the source and returns it along with the remote path to pull
+func (s sourceConfig) newDownloader() (downloader, string, error) {
+	switch {
+	case s.HTTPURL != "":
+		downloader, err := httpDownloader{
+			username: s.HTTPUser,
+			auth: httpAuth{
+				Password: secret{Value: s.HTTPPass, File: s.HTTPPassFile, Env: s.HTTPPassEnv},
+				Token:    secret{Value: s.HTTPToken, File: s.HTTPTokenFile, Env: s.HTTPTokenEnv},
+				Headers:  secretMap(s.HTTPHeaders, s.HTTPHeaderFiles, s.HTTPHeaderEnvs),
+			},
+			connectTimeout: viper.GetDuration("http-connect-timeout"),
+			headerTimeout:  viper.GetDuration("http-header-timeout"),
+			idleTimeout:    viper.GetDuration("http-idle-timeout"),
+			retries:        viper.GetInt("http-retries"),
+			retryBackoff:   viper.GetDuration("http-retry-backoff"),
+			tls: httpTLSConfig{
+				CAFile:     s.HTTPCAFile,
+				CertFile:   s.HTTPClientCert,
+				KeyFile:    s.HTTPClientKey,
+				MinVersion: s.HTTPTLSMinVersion,
+			},
+		}.withClient()
+		if err != nil {
+			return nil, "", err
+		}
+		return downloader, fmt.Sprintf("%s://%s", s.HTTPProto, s.HTTPURL), nil
+	case s.s3Resource() != "":
+		client, err := createS3Downloader(s3Options{
+			Region:               s.S3ConnRegion,
+			Endpoint:             s.S3Endpoint,
+			PathStyle:            s.S3PathStyle,
+			Profile:              s.S3Profile,
+			RoleARN:              s.S3RoleARN,
+			ExternalID:           s.S3ExternalID,
+			WebIdentityTokenFile: s.S3WebIdentityFile,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		if s.S3Versioned || s.S3VersionID != "" {
+			return s3VersionedDownloader{client, s.S3VersionID}, s.s3Resource(), nil
+		}
+		return client, s.s3Resource(), nil
+	case s.GitURL != "":
+		return gitDownloader{
+			ref:      s.GitRef,
+			cacheDir: s.GitCacheDir,
+		}, s.GitURL, nil
+	case s.OCIRef != "":
+		return ociDownloader{
+			username: s.OCIUser,
+			password: s.OCIPass,
+		}, s.OCIRef, nil
+	}
+
+	return nil, "", errors.New("no remote resource specified")
+}
+
+// selfTest checks that the credentials of an S3 source work, other sources are not checked
+func (s sourceConfig) selfTest() error {
+	if s.s3Resource() == "" {
+		return nil
+	}
+
+	downloader, remotePath, err := s.newDownloader()
+	if err != nil {
+		return errors.Wrap(err, "unable to create downloader")
+	}
+
+	tester, ok := downloader.(interface{ SelfTest(string) error })
+	if !ok {
+		return nil
+	}
+
+	return tester.SelfTest(remotePath)
+}
+
+// pull downloads the Ansible tarball from the source into localCacheFile.
+//
+// With signature verification enabled, the tarball is verified before it is used.
+// Returns the version of the source, if it is versioned.
+func (s sourceConfig) pull(localCacheFile string, signatureKeys []string) (string, error) {
+	downloader, remotePath, err := s.newDownloader()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create downloader")
+	}
+
+	version := ""
+	s3Versioned, isS3Versioned := downloader.(s3VersionedDownloader)
+	if versioned, ok := downloader.(versionedDownloader); ok {
+		if len(signatureKeys) > 0 && !isS3Versioned {
+			return "", errors.New("signature verification is not supported for versioned sources such as 'git-url' or 'oci-ref'")
+		}
+		version, err = idempotentVersionedDownload(versioned, remotePath, localCacheFile)
+	} else {
+		err = idempotentFileDownload(downloader, remotePath, s.HTTPChecksumURL, s.ChecksumAlgorithm, localCacheFile)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if len(signatureKeys) == 0 {
+		return version, nil
+	}
+
+	signatureURL := s.SignatureURL
+	if signatureURL == "" {
+		signatureURL = remotePath + ".sig"
+	}
+
+	if isS3Versioned {
+		err = verifyS3VersionSignature(s3Versioned, signatureURL, localCacheFile, signatureKeys)
+	} else {
+		err = verifyRemoteSignature(downloader, signatureURL, localCacheFile, signatureKeys)
+	}
+	if err != nil {
+		promSignatureVerificationFailed.Set(1)
+		return "", errors.Wrap(err, "unable to verify signature")
+	}
+	promSignatureVerificationFailed.Set(0)
+
+	return version, nil
+}
+
+// pullFromSources tries each source in turn until the Ansible repository could be pulled and extracted into runDir.
+//
+// Only tarballs that were pulled (and verified, if enabled) successfully are added to the bundle cache,
+// and extraction happens from the cache, so a failed pull never replaces the last good tarball.
+// A tarball with the digest skipDigest is not extracted, as its run is going to be skipped.
+// Returns the cache entry of the tarball that was pulled.
+func pullFromSources(runLogger *logrus.Entry, sources []sourceConfig, cache bundleCache, runDir, localCacheFile string, signatureKeys []string, skipDigest string) (bundleCacheEntry, error) {
+	var lastErr error
+
+	for i, source := range sources {
+		sourceLogger := runLogger.WithFields(logrus.Fields{
+			"source":  source.label(),
+			"attempt": fmt.Sprintf("%d/%d", i+1, len(sources)),
+		})
+		sourceLogger.Infoln("Pulling from source")
+
+		entry, streamed, err := source.pullStreaming(sourceLogger, runDir, signatureKeys)
+		if !streamed {
+			entry, err = pullIntoCache(source, cache, localCacheFile, signatureKeys)
+			if err == nil && entry.Digest == skipDigest {
+				sourceLogger.Infoln("Bundle ", entry.Digest, " is unchanged since the last successful run, not extracting it")
+				return entry, nil
+			}
+			if err == nil {
+				err = extractArchive(cache.Path(entry.Digest), runDir, newExtractLimits())
+				if err != nil {
+					// Never offer a broken tarball for a rollback, and start the next attempt from an empty run dir
+					if removeErr := cache.Remove(entry.Digest); removeErr != nil {
+						sourceLogger.Warnln("Unable to remove broken bundle from the cache: ", removeErr)
+					}
+					os.RemoveAll(runDir)
+					err = errors.Wrap(err, "unable to extract archive")
+				}
+			}
+		}
+		if err != nil {
+			sourceLogger.Warnln("Unable to pull from source: ", err)
+			promSourceFailures.WithLabelValues(source.label()).Inc()
+			lastErr = err
+			continue
+		}
+
+		sourceLogger.Infoln("Pulled bundle ", entry.Digest, " from source")
+		return entry, nil
+	}
+
+	return bundleCacheEntry{}, errors.Wrapf(lastErr, "all %d sources failed, last error", len(sources))
+}
+
+// pullStreaming extracts the tarball into runDir while it is downloaded, if 'stream-extract' is enabled.
+//
+// Streamed tarballs are never written to disk, so they are not added to the bundle cache and cannot be rolled back to.
+// Returns false if the source cannot be streamed, in which case it has to be pulled into the cache instead.
+func (s sourceConfig) pullStreaming(sourceLogger *logrus.Entry, runDir string, signatureKeys []string) (bundleCacheEntry, bool, error) {
+	if !viper.GetBool("stream-extract") {
+		return bundleCacheEntry{}, false, nil
+	}
+	if len(signatureKeys) > 0 {
+		sourceLogger.Infoln("Signatures can only be verified on complete tarballs, downloading instead of streaming")
+		return bundleCacheEntry{}, false, nil
+	}
+
+	downloader, remotePath, err := s.newDownloader()
+	if err != nil {
+		return bundleCacheEntry{}, true, errors.Wrap(err, "unable to create downloader")
+	}
+
+	streamer, ok := downloader.(streamingDownloader)
+	if _, versioned := downloader.(versionedDownloader); !ok || versioned {
+		sourceLogger.Infoln("Source cannot be streamed, downloading instead")
+		return bundleCacheEntry{}, false, nil
+	}
+
+	digest, err := streamExtract(streamer, remotePath, s.HTTPChecksumURL, s.ChecksumAlgorithm, runDir, newExtractLimits())
+	if err != nil {
+		return bundleCacheEntry{}, true, errors.Wrap(err, "unable to stream archive")
+	}
+
+	return bundleCacheEntry{Digest: digest, Source: s.label(), Pulled: time.Now().UTC()}, true, nil
+}
+
+// pullIntoCache pulls the tarball from the source and adds it to the bundle cache
+func pullIntoCache(source sourceConfig, cache bundleCache, localCacheFile string, signatureKeys []string) (bundleCacheEntry, error) {
+	version, err := source.pull(localCacheFile, signatureKeys)
+	if err != nil {
+		return bundleCacheEntry{}, err
+	}
+
+	return cache.Add(localCacheFile, source.label(), version)
+}
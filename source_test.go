@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestSourceTestSuite(t *testing.T) {
+	suite.Run(t, new(SourceTestSuite))
+}
+
+type SourceTestSuite struct {
+	suite.Suite
+	tmpDir     string
+	testServer *httptest.Server
+}
+
+func (s *SourceTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	good, err := ioutil.ReadFile("testdata/good.tgz")
+	assert.Nil(s.T(), err)
+
+	s.testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/good.tgz":
+			rw.Write(good)
+		case "/corrupt.tgz":
+			rw.Write(good[:len(good)/2])
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (s *SourceTestSuite) TearDownTest() {
+	s.testServer.Close()
+	os.RemoveAll(s.tmpDir)
+	viper.Set("sources", nil)
+	viper.Set("http-url", "")
+	viper.Set("http-user", "")
+	viper.Set("http-pass", "")
+	viper.Set("http-token-file", "")
+}
+
+func (s *SourceTestSuite) TestLoadSourcesFromTopLevel() {
+	viper.Set("http-url", "example.com/infra.tgz")
+
+	sources, err := loadSources()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), sources, 1)
+	assert.Equal(s.T(), "example.com/infra.tgz", sources[0].HTTPURL)
+	assert.Equal(s.T(), "https", sources[0].HTTPProto, "settings should be inherited from the top-level config")
+	assert.Equal(s.T(), "example.com/infra.tgz", sources[0].label())
+}
+
+func (s *SourceTestSuite) TestLoadSourcesList() {
+	viper.Set("http-user", "shared-user")
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"name": "regional", "http-url": "eu.example.com/infra.tgz", "http-user": "eu-user"},
+		map[string]interface{}{"http-url": "example.com/infra.tgz"},
+		map[string]interface{}{"s3-arn": "arn:aws:s3:::bucket/infra.tgz", "s3-conn-region": "eu-west-1"},
+	})
+
+	sources, err := loadSources()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), sources, 3)
+
+	assert.Equal(s.T(), "regional", sources[0].label())
+	assert.Equal(s.T(), "eu-user", sources[0].HTTPUser, "per-source credentials should win")
+	assert.Equal(s.T(), "shared-user", sources[1].HTTPUser, "credentials should be inherited")
+	assert.Equal(s.T(), "eu-west-1", sources[2].S3ConnRegion)
+}
+
+func (s *SourceTestSuite) TestLoadSourcesInheritSecrets() {
+	viper.Set("http-pass", "shared-pass")
+	viper.Set("http-token-file", "/run/secrets/token")
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"http-url": "eu.example.com/infra.tgz", "http-pass-env": "EU_PASS"},
+		map[string]interface{}{"http-url": "example.com/infra.tgz", "http-headers": map[string]interface{}{"X-JFrog-Art-Api": "key"}},
+	})
+
+	sources, err := loadSources()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", sources[0].HTTPPass, "a per-source secret file or variable should replace the inline top-level secret")
+	assert.Equal(s.T(), "EU_PASS", sources[0].HTTPPassEnv)
+	assert.Equal(s.T(), "shared-pass", sources[1].HTTPPass)
+	assert.Equal(s.T(), "/run/secrets/token", sources[1].HTTPTokenFile)
+	assert.Equal(s.T(), map[string]string{"X-JFrog-Art-Api": "key"}, sources[1].HTTPHeaders)
+}
+
+func (s *SourceTestSuite) TestPinS3Version() {
+	sources := []sourceConfig{
+		{Name: "http", HTTPURL: "example.com/infra.tgz"},
+		{Name: "primary", S3URI: "s3://primary/infra.tgz"},
+		{Name: "replica", S3URI: "s3://replica/infra.tgz"},
+	}
+
+	err := pinS3Version(sources, "replica", "version-1")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", sources[1].S3VersionID)
+	assert.Equal(s.T(), "version-1", sources[2].S3VersionID)
+
+	err = pinS3Version(sources, "", "version-2")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "", sources[0].S3VersionID, "only S3 sources should be pinned")
+	assert.Equal(s.T(), "version-2", sources[1].S3VersionID)
+
+	err = pinS3Version(sources, "http", "version-3")
+	assert.NotNil(s.T(), err)
+
+	source, err := findS3Source(sources, "")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "primary", source.Name)
+}
+
+func (s *SourceTestSuite) TestLoadSourcesInvalid() {
+	_, err := loadSources()
+	assert.NotNil(s.T(), err, "a source is required")
+
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"http-url": "example.com/infra.tgz", "s3-arn": "arn:aws:s3:::bucket/infra.tgz"},
+	})
+	_, err = loadSources()
+	assert.NotNil(s.T(), err, "a source must not define two resources")
+
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"s3-bucket": "bucket"},
+	})
+	_, err = loadSources()
+	assert.NotNil(s.T(), err, "an S3 bucket requires a key")
+
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"s3-uri": "s3://bucket"},
+	})
+	_, err = loadSources()
+	assert.NotNil(s.T(), err, "an S3 URI requires a key")
+}
+
+func (s *SourceTestSuite) TestLoadSourcesS3BucketKey() {
+	viper.Set("sources", []interface{}{
+		map[string]interface{}{"s3-bucket": "bucket", "s3-key": "/infra/bundle.tgz", "s3-endpoint": "https://minio.example.com", "s3-path-style": true},
+		map[string]interface{}{"s3-uri": "s3://bucket/infra/bundle.tgz"},
+	})
+
+	sources, err := loadSources()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "s3://bucket/infra/bundle.tgz", sources[0].label())
+	assert.True(s.T(), sources[0].S3PathStyle)
+	assert.Equal(s.T(), "s3://bucket/infra/bundle.tgz", sources[1].label())
+}
+
+func (s *SourceTestSuite) TestPullFromSourcesFailover() {
+	host := strings.TrimPrefix(s.testServer.URL, "http://")
+	sources := []sourceConfig{
+		{Name: "missing", HTTPURL: host + "/missing.tgz", HTTPProto: "http"},
+		{Name: "corrupt", HTTPURL: host + "/corrupt.tgz", HTTPProto: "http"},
+		{Name: "good", HTTPURL: host + "/good.tgz", HTTPProto: "http"},
+	}
+	runDir := filepath.Join(s.tmpDir, "run")
+	localCacheFile := filepath.Join(s.tmpDir, "bundle.tgz")
+
+	cache := bundleCache{Dir: filepath.Join(s.tmpDir, "bundles"), Keep: 5}
+
+	entry, err := pullFromSources(logrus.WithField("run_id", "test"), sources, cache, runDir, localCacheFile, nil, "")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "good", entry.Source)
+
+	entries, err := cache.List()
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), entries, 1, "only the good tarball should be cached")
+
+	_, err = os.Stat(filepath.Join(runDir, "foo.txt"))
+	assert.Nil(s.T(), err, "tarball should be extracted")
+}
+
+func (s *SourceTestSuite) TestPullFromSourcesAllFail() {
+	host := strings.TrimPrefix(s.testServer.URL, "http://")
+	sources := []sourceConfig{
+		{HTTPURL: host + "/missing.tgz", HTTPProto: "http"},
+		{HTTPURL: host + "/also-missing.tgz", HTTPProto: "http"},
+	}
+	localCacheFile := filepath.Join(s.tmpDir, "bundle.tgz")
+
+	cache := bundleCache{Dir: filepath.Join(s.tmpDir, "bundles"), Keep: 5}
+
+	_, err := pullFromSources(logrus.WithField("run_id", "test"), sources, cache, filepath.Join(s.tmpDir, "run"), localCacheFile, nil, "")
+	assert.NotNil(s.T(), err)
+}
+
+func (s *SourceTestSuite) TestPullFromSourcesSkipsUnchanged() {
+	host := strings.TrimPrefix(s.testServer.URL, "http://")
+	sources := []sourceConfig{{Name: "good", HTTPURL: host + "/good.tgz", HTTPProto: "http"}}
+	localCacheFile := filepath.Join(s.tmpDir, "bundle.tgz")
+	cache := bundleCache{Dir: filepath.Join(s.tmpDir, "bundles"), Keep: 5}
+
+	entry, err := pullFromSources(logrus.WithField("run_id", "test"), sources, cache, filepath.Join(s.tmpDir, "run"), localCacheFile, nil, "")
+	assert.Nil(s.T(), err)
+
+	runDir := filepath.Join(s.tmpDir, "unchanged")
+	unchanged, err := pullFromSources(logrus.WithField("run_id", "test"), sources, cache, runDir, localCacheFile, nil, entry.Digest)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), entry.Digest, unchanged.Digest)
+
+	_, err = os.Stat(runDir)
+	assert.True(s.T(), os.IsNotExist(err), "unchanged tarball should not be extracted")
+}
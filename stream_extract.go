@@ -0,0 +1,78 @@
+// Extraction of bundles while they are downloaded, for hosts without the disk space to keep the tarball around
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Path of the sibling dir that a stream is extracted into until its checksum has been verified
+func stagedExtractPath(dest string) string {
+	return dest + ".stream"
+}
+
+// streamExtract downloads the archive at remotePath and extracts it into dest while it is downloaded,
+// without ever writing the archive itself to disk.
+//
+// The archive is hashed on the fly and extracted next to dest. The extracted tree only replaces dest
+// once the digest matches the remote checksum, so a remote checksum is required.
+// Returns the SHA-256 digest of the archive, which identifies the bundle like a cached tarball.
+func streamExtract(downloader streamingDownloader, remotePath, checksumURL, checksumAlgorithm, dest string, limits extractLimits) (string, error) {
+	algorithm, remoteChecksum, err := resolveRemoteChecksum(downloader, remotePath, checksumURL, checksumAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	if remoteChecksum == "" {
+		return "", errors.New("extracting while downloading requires a remote checksum to verify the bundle")
+	}
+
+	logrus.Infof("Streaming file: %s", remotePath)
+	stream, err := downloader.Open(remotePath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download")
+	}
+	defer stream.Close()
+
+	checksumHash := checksumAlgorithms[algorithm]()
+	bundleHash := checksumAlgorithms[bundleCacheAlgorithm]()
+	hashedStream := io.TeeReader(stream, io.MultiWriter(checksumHash, bundleHash))
+
+	stagedPath := stagedExtractPath(dest)
+	if err := os.RemoveAll(stagedPath); err != nil {
+		return "", errors.Wrap(err, "failed to remove stale extraction")
+	}
+
+	err = extractArchiveStream(hashedStream, stagedPath, limits)
+	if err == nil {
+		// Anything after the end of the tarball, such as padding, is covered by the checksum as well
+		_, err = io.Copy(ioutil.Discard, hashedStream)
+	}
+	if err != nil {
+		os.RemoveAll(stagedPath)
+		return "", errors.Wrap(err, "failed to extract download")
+	}
+
+	logrus.Infof("Validating checksum: %s", remotePath)
+	if checksum := hex.EncodeToString(checksumHash.Sum(nil)); checksum != remoteChecksum {
+		os.RemoveAll(stagedPath)
+		logrus.Debugf("Checksums for streamed file do not match: '%s' != '%s'", checksum, remoteChecksum)
+		return "", fmt.Errorf("failed to validate %s checksum: checksum does not match expected value", algorithm)
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		os.RemoveAll(stagedPath)
+		return "", errors.Wrap(err, "failed to replace extracted tree")
+	}
+	if err := os.Rename(stagedPath, dest); err != nil {
+		return "", errors.Wrap(err, "failed to replace extracted tree")
+	}
+
+	return hex.EncodeToString(bundleHash.Sum(nil)), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestStreamExtractTestSuite(t *testing.T) {
+	suite.Run(t, new(StreamExtractTestSuite))
+}
+
+// StreamExtractTestSuite streams testdata/good.tar.zst from a server that publishes its SHA-256 checksum
+type StreamExtractTestSuite struct {
+	suite.Suite
+	tmpDir     string
+	testServer *httptest.Server
+	bundle     []byte
+	checksum   string
+}
+
+func (s *StreamExtractTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.bundle, err = ioutil.ReadFile("testdata/good.tar.zst")
+	assert.Nil(s.T(), err)
+	digest := sha256.Sum256(s.bundle)
+	s.checksum = hex.EncodeToString(digest[:])
+
+	s.testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/bundle.tar.zst", "/unverified.tar.zst":
+			rw.Write(s.bundle)
+		case "/bundle.tar.zst.sha256":
+			rw.Write([]byte(s.checksum))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func (s *StreamExtractTestSuite) TearDownTest() {
+	s.testServer.Close()
+	os.RemoveAll(s.tmpDir)
+}
+
+// runDir returns an existing run dir with a marker file, to check whether it was replaced
+func (s *StreamExtractTestSuite) runDir() string {
+	runDir := filepath.Join(s.tmpDir, "run")
+	assert.Nil(s.T(), os.MkdirAll(runDir, 0755))
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(runDir, "marker"), nil, 0644))
+	return runDir
+}
+
+func (s *StreamExtractTestSuite) TestStreamExtract() {
+	runDir := s.runDir()
+
+	digest, err := streamExtract(httpDownloader{}, s.testServer.URL+"/bundle.tar.zst", testEmptyChecksumUrl, "sha256", runDir, extractLimits{})
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), s.checksum, digest)
+
+	_, err = os.Stat(filepath.Join(runDir, "foo.txt"))
+	assert.Nil(s.T(), err)
+	_, err = os.Stat(filepath.Join(runDir, "marker"))
+	assert.True(s.T(), os.IsNotExist(err), "run dir should be replaced by the extracted tree")
+	_, err = os.Stat(stagedExtractPath(runDir))
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
+func (s *StreamExtractTestSuite) TestStreamExtractChecksumMismatch() {
+	runDir := s.runDir()
+	s.checksum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	_, err := streamExtract(httpDownloader{}, s.testServer.URL+"/bundle.tar.zst", testEmptyChecksumUrl, "sha256", runDir, extractLimits{})
+	assert.NotNil(s.T(), err)
+
+	_, err = os.Stat(filepath.Join(runDir, "marker"))
+	assert.Nil(s.T(), err, "run dir should be kept when the checksum does not match")
+	_, err = os.Stat(filepath.Join(runDir, "foo.txt"))
+	assert.True(s.T(), os.IsNotExist(err))
+	_, err = os.Stat(stagedExtractPath(runDir))
+	assert.True(s.T(), os.IsNotExist(err), "unverified tree should be removed")
+}
+
+func (s *StreamExtractTestSuite) TestStreamExtractRequiresChecksum() {
+	runDir := s.runDir()
+
+	_, err := streamExtract(httpDownloader{}, s.testServer.URL+"/unverified.tar.zst", testEmptyChecksumUrl, "sha256", runDir, extractLimits{})
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "requires a remote checksum")
+}
+
+func (s *StreamExtractTestSuite) TestStreamExtractMissingFile() {
+	s.checksum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	_, err := streamExtract(httpDownloader{}, s.testServer.URL+"/bundle.tar.zst.missing", s.testServer.URL+"/bundle.tar.zst.sha256", "sha256", s.runDir(), extractLimits{})
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "bad status code: 404")
+}
@@ -1,64 +1,187 @@
-// Functions for expanding gzipped tarballs
+// Functions for expanding bundles: tarballs, compressed with gzip, zstd, xz or bzip2, and zip archives
 
 package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-// Ensures that a given file is gzip-encoded
-func ensureGzip(file io.Reader) error {
-	buff := make([]byte, 512) // content-type length
+type archiveFormat string
 
-	_, err := file.Read(buff)
-	if err != nil {
-		return errors.Wrap(err, "unable to detect encoding")
+const (
+	archiveTar      archiveFormat = "tar"
+	archiveTarGzip  archiveFormat = "tar+gzip"
+	archiveTarZstd  archiveFormat = "tar+zstd"
+	archiveTarXz    archiveFormat = "tar+xz"
+	archiveTarBzip2 archiveFormat = "tar+bzip2"
+	archiveZip      archiveFormat = "zip"
+
+	maxZipSymlinkLength = 4096 // Zip archives store symlink targets as file contents
+)
+
+var archiveMagics = []struct {
+	offset int
+	magic  []byte
+	format archiveFormat
+}{
+	{0, []byte{0x1f, 0x8b}, archiveTarGzip},
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}, archiveTarZstd},
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, archiveTarXz},
+	{0, []byte("BZh"), archiveTarBzip2},
+	{0, []byte("PK\x03\x04"), archiveZip},
+	{0, []byte("PK\x05\x06"), archiveZip}, // Empty zip archive
+	{257, []byte("ustar"), archiveTar},
+}
+
+// detectArchiveFormat detects the format of an archive from its magic bytes, file extensions are not needed
+func detectArchiveFormat(file io.Reader) (archiveFormat, error) {
+	buff := make([]byte, 512) // tar header length
+
+	n, err := io.ReadFull(file, buff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", errors.Wrap(err, "unable to detect archive format")
 	}
+	buff = buff[:n]
 
-	if filetype := http.DetectContentType(buff); filetype != "application/x-gzip" {
-		return fmt.Errorf("file not gzip encoded")
+	for _, m := range archiveMagics {
+		if len(buff) >= m.offset+len(m.magic) && bytes.Equal(buff[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format, nil
+		}
 	}
 
-	return nil
+	return "", errors.New("unknown archive format, expected a tarball (uncompressed, gzip, zstd, xz or bzip2) or a zip archive")
+}
+
+// decompress returns the tarball of a compressed archive
+func decompress(format archiveFormat, file io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case archiveTarGzip:
+		return gzip.NewReader(file)
+	case archiveTarZstd:
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case archiveTarXz:
+		reader, err := xz.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	case archiveTarBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(file)), nil
+	}
+
+	return ioutil.NopCloser(file), nil
 }
 
-// Extract a tarball from the src into dest
-func extractTgz(src, dest string) error {
+// extractLimits bounds what a tarball may extract to, so that a bad bundle cannot fill the disk. 0 disables a limit.
+type extractLimits struct {
+	MaxBytes int64 // Total size of the extracted files
+	MaxFiles int   // Number of entries
+}
+
+// Extract an archive from the src into dest
+//
+// Entries that would end up outside of dest are not extracted: absolute paths, paths escaping with "..", paths
+// through a symlink and links pointing out of the tree. Every rejected entry is reported in the returned error.
+func extractArchive(src, dest string, limits extractLimits) error {
 	logrus.Debugf("Expanding %s to %s", src, dest)
-	tgzFile, err := os.Open(src)
+	archiveFile, err := os.Open(src)
 	if err != nil {
 		return errors.Wrap(err, "unable to open source file")
 	}
-	defer tgzFile.Close()
+	defer archiveFile.Close()
+
+	format, err := detectArchiveFormat(archiveFile)
+	if err != nil {
+		return err
+	}
+	if _, err := archiveFile.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "unable to rewind archive")
+	}
+	logrus.Debugf("Detected %s archive", format)
+
+	if format == archiveZip {
+		if err := createExtractDir(dest); err != nil {
+			return err
+		}
+		info, err := archiveFile.Stat()
+		if err != nil {
+			return errors.Wrap(err, "unable to stat archive")
+		}
+		e := &extraction{dest: dest, limits: limits}
+		return e.finish(extractZip(e, archiveFile, info.Size()))
+	}
 
-	err = ensureGzip(tgzFile)
+	return extractTarball(format, archiveFile, dest, limits)
+}
+
+// extractArchiveStream extracts a tarball from r into dest while it is read, e.g. while it is downloaded.
+// Zip archives cannot be streamed, as their index is at the end.
+func extractArchiveStream(r io.Reader, dest string, limits extractLimits) error {
+	buffered := bufio.NewReader(r)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "unable to detect archive format")
+	}
+
+	format, err := detectArchiveFormat(bytes.NewReader(head))
 	if err != nil {
-		return errors.Wrap(err, "unable to make gzip reader")
+		return err
+	}
+	if format == archiveZip {
+		return errors.New("zip archives cannot be extracted while they are downloaded")
 	}
-	tgzFile.Seek(0, 0)
+	logrus.Debugf("Detected %s archive", format)
 
-	uncompressedStream, err := gzip.NewReader(tgzFile)
+	return extractTarball(format, buffered, dest, limits)
+}
+
+// extractTarball decompresses and extracts a tarball of the given format
+func extractTarball(format archiveFormat, r io.Reader, dest string, limits extractLimits) error {
+	if err := createExtractDir(dest); err != nil {
+		return err
+	}
+
+	uncompressedStream, err := decompress(format, r)
 	if err != nil {
-		errors.Wrap(err, "unable to make gzip reader")
+		return errors.Wrapf(err, "unable to make %s reader", format)
 	}
 	defer uncompressedStream.Close()
 
-	tarReader := tar.NewReader(uncompressedStream)
+	e := &extraction{dest: dest, limits: limits}
+	return e.finish(extractTar(e, tar.NewReader(uncompressedStream)))
+}
 
+func createExtractDir(dest string) error {
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
 		if err := os.Mkdir(dest, 0755); err != nil {
 			return errors.Wrap(err, "unable to create target directory")
 		}
 	}
 
+	return nil
+}
+
+// extractTar extracts all entries of a tarball
+func extractTar(e *extraction, tarReader *tar.Reader) error {
 	for {
 		header, err := tarReader.Next()
 
@@ -66,37 +189,318 @@ func extractTgz(src, dest string) error {
 		case err == io.EOF:
 			return nil
 		case err != nil:
-			return errors.Wrap(err, "unable to extract gzipped tarfile")
+			return errors.Wrap(err, "unable to read tarball")
 		case header == nil:
 			continue // phantom file case
 		}
 
-		targetPath := filepath.Join(dest, header.Name)
+		if err := e.add(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
 
-		switch header.Typeflag {
-		case tar.TypeSymlink:
-			if err := os.Symlink(header.Linkname, targetPath); err != nil {
-				return errors.Wrap(err, "unable to create symlink from tar")
-			}
+// extractZip extracts all entries of a zip archive, by converting them to tar entries
+func extractZip(e *extraction, file io.ReaderAt, size int64) error {
+	zipReader, err := zip.NewReader(file, size)
+	if err != nil {
+		return errors.Wrap(err, "unable to read zip archive")
+	}
 
-		case tar.TypeDir:
-			if _, err := os.Stat(targetPath); os.IsNotExist(err) {
-				if err := os.Mkdir(targetPath, 0755); err != nil {
-					return errors.Wrap(err, "unable to create dir from tar")
-				}
-			}
+	for _, f := range zipReader.File {
+		if err := extractZipEntry(e, f); err != nil {
+			return err
+		}
+	}
 
-		case tar.TypeReg:
-			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return errors.Wrap(err, "unable to create file from tar")
-			}
+	return nil
+}
 
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return errors.Wrap(err, "unable to populate file from tar")
-			}
+func extractZipEntry(e *extraction, f *zip.File) error {
+	contents, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "unable to read %s from zip archive", f.Name)
+	}
+	defer contents.Close()
 
-			outFile.Close()
+	linkname := ""
+	if f.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(contents, maxZipSymlinkLength))
+		if err != nil {
+			return errors.Wrapf(err, "unable to read symlink %s from zip archive", f.Name)
 		}
+		linkname = string(target)
+	}
+
+	header, err := tar.FileInfoHeader(f.FileInfo(), linkname)
+	if err != nil {
+		return errors.Wrapf(err, "unsupported zip entry %s", f.Name)
 	}
+	header.Name = f.Name
+
+	return e.add(header, contents)
+}
+
+// extraction keeps track of the entries of an archive that is extracted into dest
+type extraction struct {
+	dest     string
+	limits   extractLimits
+	rejected []string
+	dirs     []extractedDir
+	files    int
+	size     int64
+}
+
+// add extracts a single entry, or records it as rejected if it is unsafe
+func (e *extraction) add(header *tar.Header, contents io.Reader) error {
+	if header.Typeflag == tar.TypeRegA {
+		// Written by old tar implementations for regular files
+		header.Typeflag = tar.TypeReg
+	}
+
+	e.files++
+	if e.limits.MaxFiles > 0 && e.files > e.limits.MaxFiles {
+		return fmt.Errorf("archive has more than %d entries", e.limits.MaxFiles)
+	}
+	if header.Typeflag == tar.TypeReg {
+		e.size += header.Size
+		if e.limits.MaxBytes > 0 && e.size > e.limits.MaxBytes {
+			return fmt.Errorf("archive extracts to more than %d bytes", e.limits.MaxBytes)
+		}
+	}
+
+	targetPath, err := safeTarPath(e.dest, header)
+	if err != nil {
+		logrus.Warnf("Rejected archive entry %s: %v", header.Name, err)
+		e.rejected = append(e.rejected, fmt.Sprintf("%s: %v", header.Name, err))
+		return nil
+	}
+
+	if err := extractTarEntry(contents, header, e.dest, targetPath); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeDir {
+		e.dirs = append(e.dirs, extractedDir{path: targetPath, header: header})
+	}
+
+	return nil
+}
+
+// finish restores the extracted directories if extraction succeeded, and adds the rejected entries to the error
+func (e *extraction) finish(err error) error {
+	if err == nil {
+		err = restoreDirs(e.dirs)
+	}
+
+	return rejectedEntriesError(err, e.rejected)
+}
+
+// extractedDir is a directory whose mode and modification time are restored once all entries are extracted
+type extractedDir struct {
+	path   string
+	header *tar.Header
+}
+
+// extractTarEntry creates a single entry of the tarball at targetPath, along with any missing parent directories
+func extractTarEntry(tarReader io.Reader, header *tar.Header, dest, targetPath string) error {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+	case tar.TypeXGlobalHeader:
+		// Only holds PAX records for the whole tarball, e.g. the commit that git archive was run on
+		return nil
+	default:
+		logrus.Warnf("Skipping tar entry %s of unsupported type %q", header.Name, header.Typeflag)
+		return nil
+	}
+
+	// Tarballs do not need to have entries for parent directories, or may list them after their contents
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return errors.Wrap(err, "unable to create parent dir from tar")
+	}
+
+	if header.Typeflag == tar.TypeDir {
+		if err := os.Mkdir(targetPath, 0755); err != nil && !os.IsExist(err) {
+			return errors.Wrap(err, "unable to create dir from tar")
+		}
+		return nil
+	}
+
+	// Later entries replace earlier ones, without writing through to other hardlinks of the same file
+	if info, err := os.Lstat(targetPath); err == nil && !info.IsDir() {
+		if err := os.Remove(targetPath); err != nil {
+			return errors.Wrap(err, "unable to replace file from tar")
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, targetPath); err != nil {
+			return errors.Wrap(err, "unable to create symlink from tar")
+		}
+
+	case tar.TypeLink:
+		// Hardlinks share the mode and modification time of the file they link to
+		if err := os.Link(filepath.Join(dest, filepath.FromSlash(header.Linkname)), targetPath); err != nil {
+			return errors.Wrap(err, "unable to create hardlink from tar")
+		}
+
+	case tar.TypeReg:
+		mode := header.FileInfo().Mode()
+		outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return errors.Wrap(err, "unable to create file from tar")
+		}
+
+		_, err = io.Copy(outFile, tarReader)
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to populate file from tar")
+		}
+
+		// The umask applies to OpenFile. Setuid, setgid and sticky bits are dropped, as files are extracted as root.
+		if err := os.Chmod(targetPath, mode.Perm()); err != nil {
+			return errors.Wrap(err, "unable to set file mode from tar")
+		}
+		if err := os.Chtimes(targetPath, header.ModTime, header.ModTime); err != nil {
+			return errors.Wrap(err, "unable to set file modification time from tar")
+		}
+	}
+
+	return nil
+}
+
+// restoreDirs sets the mode and modification time of the extracted directories.
+//
+// This happens after all entries are extracted, as adding entries changes the modification time of their
+// directory, and a read-only mode would prevent adding them. Children are restored before their parents.
+func restoreDirs(dirs []extractedDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if err := os.Chmod(dir.path, dir.header.FileInfo().Mode().Perm()); err != nil {
+			return errors.Wrap(err, "unable to set dir mode from tar")
+		}
+		if err := os.Chtimes(dir.path, dir.header.ModTime, dir.header.ModTime); err != nil {
+			return errors.Wrap(err, "unable to set dir modification time from tar")
+		}
+	}
+
+	return nil
+}
+
+// rejectedEntriesError adds the rejected archive entries to err, if there are any
+func rejectedEntriesError(err error, rejected []string) error {
+	if len(rejected) == 0 {
+		return err
+	}
+
+	rejectedErr := fmt.Errorf("rejected %d unsafe archive entries: %s", len(rejected), strings.Join(rejected, "; "))
+	if err == nil {
+		return rejectedErr
+	}
+	return errors.Wrap(err, rejectedErr.Error())
+}
+
+// safeTarPath returns the path that the tar entry extracts to, or an error if it would end up outside of dest.
+//
+// Entries may not be written through symlinks, not even ones pointing inside the tree, and symlink targets may only
+// go up before going down. Together this guarantees that every extracted symlink resolves within dest.
+func safeTarPath(dest string, header *tar.Header) (string, error) {
+	name, err := cleanTarName(header.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureNoSymlinks(dest, name); err != nil {
+		return "", err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if err := checkSymlinkTarget(name, header.Linkname); err != nil {
+			return "", err
+		}
+
+	case tar.TypeLink:
+		// Hardlink targets are relative to the root of the tarball
+		linkname, err := cleanTarName(header.Linkname)
+		if err != nil {
+			return "", fmt.Errorf("hardlink target %s: %v", header.Linkname, err)
+		}
+		if err := ensureNoSymlinks(dest, linkname); err != nil {
+			return "", fmt.Errorf("hardlink target %s: %v", header.Linkname, err)
+		}
+	}
+
+	return filepath.Join(dest, name), nil
+}
+
+// cleanTarName returns the cleaned relative path of a tar entry, or an error if it is absolute or escapes the tree
+func cleanTarName(name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute path")
+	}
+
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", errors.New("path escapes the target directory")
+	}
+
+	return cleaned, nil
+}
+
+// ensureNoSymlinks makes sure that no existing component of name below dest is a symlink
+func ensureNoSymlinks(dest, name string) error {
+	path := dest
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(dest, path)
+			return fmt.Errorf("path goes through symlink %s", rel)
+		}
+	}
+
+	return nil
+}
+
+// checkSymlinkTarget makes sure that the symlink at name points within the tree.
+//
+// The target may only go up with leading ".." components, as a ".." after a symlink component
+// would resolve relative to where that symlink points instead of where it is.
+func checkSymlinkTarget(name, target string) error {
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return fmt.Errorf("symlink to absolute path %s", target)
+	}
+
+	depth := strings.Count(name, string(filepath.Separator))
+	up := 0
+	down := false
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if down {
+				return fmt.Errorf("symlink target %s goes up after going down", target)
+			}
+			up++
+		default:
+			down = true
+		}
+	}
+	if up > depth {
+		return fmt.Errorf("symlink to %s points out of the tree", target)
+	}
+
+	return nil
 }
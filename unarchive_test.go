@@ -1,11 +1,16 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Register the below test suite
@@ -29,7 +34,7 @@ func (s *UnarchiveTestSuite) TearDownTest() {
 }
 
 func (s *UnarchiveTestSuite) TestTarballExists() {
-	err := extractTgz("testdata/good.tgz", s.tmpDir)
+	err := extractArchive("testdata/good.tgz", s.tmpDir, extractLimits{})
 	assert.Nil(s.T(), err)
 
 	stats, err := os.Stat(s.tmpDir + "/foo.txt")
@@ -41,17 +46,202 @@ func (s *UnarchiveTestSuite) TestTarballExists() {
 	assert.True(s.T(), stats.Mode().IsRegular(), "should create a regular bar file")
 }
 
+func (s *UnarchiveTestSuite) TestArchiveFormats() {
+	expectedDir := filepath.Join(s.tmpDir, "good.tgz")
+	assert.Nil(s.T(), extractArchive("testdata/good.tgz", expectedDir, extractLimits{}))
+
+	for _, fixture := range []string{"good.tar", "good.tar.zst", "good.tar.xz", "good.tar.bz2", "good.zip"} {
+		dest := filepath.Join(s.tmpDir, fixture)
+		err := extractArchive("testdata/"+fixture, dest, extractLimits{})
+		assert.Nil(s.T(), err, fixture)
+
+		for _, name := range []string{"foo.txt", "bar.txt"} {
+			expected, err := ioutil.ReadFile(filepath.Join(expectedDir, name))
+			assert.Nil(s.T(), err)
+
+			text, err := ioutil.ReadFile(filepath.Join(dest, name))
+			assert.Nil(s.T(), err, fixture)
+			assert.Equal(s.T(), expected, text, "%s should have the same contents as good.tgz", fixture)
+		}
+	}
+}
+
+func (s *UnarchiveTestSuite) TestUnknownArchiveFormat() {
+	err := extractArchive("unarchive.go", s.tmpDir, extractLimits{})
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "unknown archive format")
+}
+
+func (s *UnarchiveTestSuite) TestZipSymlinks() {
+	archive := filepath.Join(s.tmpDir, "links.zip")
+	dest := filepath.Join(s.tmpDir, "dest")
+
+	f, err := os.Create(archive)
+	assert.Nil(s.T(), err)
+	zipWriter := zip.NewWriter(f)
+	for _, entry := range []struct {
+		name, contents string
+		mode           os.FileMode
+	}{
+		{"playbook.yml", "- hosts: all", 0644},
+		{"site.yml", "playbook.yml", os.ModeSymlink | 0777},
+		{"passwd", "../../../etc/passwd", os.ModeSymlink | 0777},
+		{"../escaped.txt", "escaped", 0644},
+	} {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+		w, err := zipWriter.CreateHeader(header)
+		assert.Nil(s.T(), err)
+		_, err = w.Write([]byte(entry.contents))
+		assert.Nil(s.T(), err)
+	}
+	assert.Nil(s.T(), zipWriter.Close())
+	assert.Nil(s.T(), f.Close())
+
+	err = extractArchive(archive, dest, extractLimits{})
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "rejected 2 unsafe archive entries")
+
+	text, err := ioutil.ReadFile(filepath.Join(dest, "site.yml"))
+	assert.Nil(s.T(), err, "symlinks should be extracted from zip archives")
+	assert.Equal(s.T(), "- hosts: all", string(text))
+
+	_, err = os.Stat(filepath.Join(s.tmpDir, "escaped.txt"))
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
 func (s *UnarchiveTestSuite) TestTarballDoesNotExist() {
-	err := extractTgz("testdata/somethingthatdoesnotexist.tgz", s.tmpDir)
+	err := extractArchive("testdata/somethingthatdoesnotexist.tgz", s.tmpDir, extractLimits{})
 	assert.NotNil(s.T(), err)
 }
 
 func (s *UnarchiveTestSuite) TestTarballIsCorrupted() {
-	err := extractTgz("testdata/corrupt.tgz", s.tmpDir)
+	err := extractArchive("testdata/corrupt.tgz", s.tmpDir, extractLimits{})
 	assert.NotNil(s.T(), err)
 }
 
 func (s *UnarchiveTestSuite) TestTarballHasInvalidBody() {
-	err := extractTgz("testdata/half.tgz", s.tmpDir)
+	err := extractArchive("testdata/half.tgz", s.tmpDir, extractLimits{})
+	assert.NotNil(s.T(), err)
+}
+
+// writeTestTgz writes a gzipped tarball with the given entries, file contents are their names
+func writeTestTgz(t *testing.T, path string, entries []tar.Header) {
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, header := range entries {
+		header := header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		assert.Nil(t, tarWriter.WriteHeader(&header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tarWriter.Write([]byte(header.Name))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, tarWriter.Close())
+	assert.Nil(t, gzipWriter.Close())
+}
+
+func (s *UnarchiveTestSuite) TestTarballRejectsUnsafeEntries() {
+	tgz := filepath.Join(s.tmpDir, "unsafe.tgz")
+	dest := filepath.Join(s.tmpDir, "run", "dest")
+	assert.Nil(s.T(), os.MkdirAll(dest, 0755))
+
+	writeTestTgz(s.T(), tgz, []tar.Header{
+		{Name: "good.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "../escaped.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "sub/../../escaped.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/tmp/absolute.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "sneaky", Typeflag: tar.TypeSymlink, Linkname: "dir/../.."},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../escaped.txt"},
+		{Name: "dir", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/inside", Typeflag: tar.TypeSymlink, Linkname: "../good.txt"},
+		{Name: "alias", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+		{Name: "alias/through.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	})
+
+	err := extractArchive(tgz, dest, extractLimits{})
+	assert.NotNil(s.T(), err)
+	for _, name := range []string{"../escaped.txt", "sub/../../escaped.txt", "/tmp/absolute.txt", "up", "etc", "sneaky", "hard", "alias/through.txt"} {
+		assert.Contains(s.T(), err.Error(), name+": ", "every rejected entry should be reported")
+	}
+	assert.Contains(s.T(), err.Error(), "rejected 8 unsafe archive entries")
+
+	for _, path := range []string{filepath.Join(s.tmpDir, "run", "escaped.txt"), "/tmp/absolute.txt", filepath.Join(dest, "up"), filepath.Join(dest, "dir", "through.txt")} {
+		_, err := os.Lstat(path)
+		assert.True(s.T(), os.IsNotExist(err), "%s should not have been created", path)
+	}
+
+	text, err := ioutil.ReadFile(filepath.Join(dest, "dir", "inside"))
+	assert.Nil(s.T(), err, "symlinks within the tree are kept")
+	assert.Equal(s.T(), "good.txt", string(text))
+}
+
+func (s *UnarchiveTestSuite) TestTarballLimits() {
+	err := extractArchive("testdata/good.tgz", s.tmpDir, extractLimits{MaxFiles: 1})
 	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "more than 1 entries")
+
+	err = extractArchive("testdata/good.tgz", s.tmpDir, extractLimits{MaxBytes: 100})
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "more than 100 bytes")
+
+	err = extractArchive("testdata/good.tgz", s.tmpDir, extractLimits{MaxFiles: 2, MaxBytes: 319})
+	assert.Nil(s.T(), err)
+}
+
+func (s *UnarchiveTestSuite) TestTarballFeatures() {
+	tgz := filepath.Join(s.tmpDir, "features.tgz")
+	dest := filepath.Join(s.tmpDir, "dest")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeTestTgz(s.T(), tgz, []tar.Header{
+		{Name: "roles/common/tasks/main.yml", Typeflag: tar.TypeReg, Mode: 0600, ModTime: modTime},
+		{Name: "bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: modTime},
+		{Name: "bin/link.sh", Typeflag: tar.TypeLink, Linkname: "bin/run.sh"},
+		{Name: "bin/setuid", Typeflag: tar.TypeReg, Mode: 04755, ModTime: modTime},
+		{Name: "pipe", Typeflag: tar.TypeFifo, Mode: 0644},
+		{Name: "roles/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: modTime},
+		{Name: "shared/", Typeflag: tar.TypeDir, Mode: 03777, ModTime: modTime},
+	})
+
+	err := extractArchive(tgz, dest, extractLimits{})
+	assert.Nil(s.T(), err)
+
+	stats, err := os.Stat(filepath.Join(dest, "roles/common/tasks/main.yml"))
+	assert.Nil(s.T(), err, "missing parent dirs should be created")
+	assert.Equal(s.T(), os.FileMode(0600), stats.Mode())
+	assert.True(s.T(), stats.ModTime().Equal(modTime), "modification time should be preserved")
+
+	stats, err = os.Stat(filepath.Join(dest, "bin/run.sh"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.FileMode(0755), stats.Mode())
+
+	linkStats, err := os.Stat(filepath.Join(dest, "bin/link.sh"))
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), os.SameFile(stats, linkStats), "hardlink should share the file")
+
+	stats, err = os.Stat(filepath.Join(dest, "roles"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.FileMode(0750)|os.ModeDir, stats.Mode(), "dir entries after their contents should apply")
+	assert.True(s.T(), stats.ModTime().Equal(modTime))
+
+	stats, err = os.Stat(filepath.Join(dest, "bin/setuid"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.FileMode(0755), stats.Mode(), "setuid bit should be dropped")
+
+	stats, err = os.Stat(filepath.Join(dest, "shared"))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), os.FileMode(0777)|os.ModeDir, stats.Mode(), "setgid and sticky bits should be dropped")
+
+	_, err = os.Lstat(filepath.Join(dest, "pipe"))
+	assert.True(s.T(), os.IsNotExist(err), "unsupported entries should be skipped")
 }
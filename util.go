@@ -1,10 +1,15 @@
 package main
 
 import (
-	"github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 // failedCommandLogger will print a bunch of context to the terminal when in debug mode
@@ -27,3 +32,49 @@ func trimMultilineWhiteSpace(s string) string {
 
 	return strings.Join(result, "\n")
 }
+
+// writeAtomic writes to dst through a temporary file in the same directory, so that dst
+// is either left untouched or completely replaced.
+func writeAtomic(dst string, perm os.FileMode, write func(*os.File) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeFileAtomic is like ioutil.WriteFile, but never leaves a partially written file behind.
+func writeFileAtomic(dst string, data []byte, perm os.FileMode) error {
+	return writeAtomic(dst, perm, func(w *os.File) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// copyFileAtomic copies src to dst, so that dst is either left untouched or completely replaced.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeAtomic(dst, 0600, func(w *os.File) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -6,11 +6,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -23,10 +28,42 @@ var (
 	venvCommandTimeout = 2 * time.Hour // 2 hours timeout
 )
 
+// File in the virtualenv that records what it was last updated from
+const venvStateFile = ".ansible-puller-state.json"
+
+// Matches lines of a requirements file that include another requirements or constraints file
+var requirementsIncludeLine = regexp.MustCompile(`^(?:-r|-c|--requirement|--constraint)(?:\s*=\s*|\s+)(\S+)`)
+
+// Matches pip's error for a requirement that has no installable distribution
+var pipNoMatchingDistribution = regexp.MustCompile(`No matching distribution found for (\S+)`)
+
+// Matches where the name of a requirement ends, e.g. at a version specifier, marker or extras
+var requirementNameEnd = regexp.MustCompile(`[<>=!~;\[@ ]`)
+
+// Matches runs of the characters that are equivalent in Python package names
+var packageNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// venvState describes the inputs of the last successful virtualenv update.
+// While none of them change, running pip install again would not change the virtualenv.
+type venvState struct {
+	Backend       string `json:"backend"`
+	Requirements  string `json:"requirements_sha256"` // Digest of the requirements file and the files it includes
+	PythonVersion string `json:"python_version"`
+	ToolVersion   string `json:"tool_version"` // Version of pip, or of the tool of another backend
+}
+
 // VenvConfig defines a Python Virtual Environment.
 type VenvConfig struct {
-	Path   string // path to the virtualenv root
-	Python string // path to the desired Python installation
+	Path      string   // path to the virtualenv root
+	Python    string   // path to the desired Python installation
+	BlueGreen bool     // Build changed virtualenvs next to the live one and switch Path over to them, see updateBlueGreen
+	SmokeTest []string // Command that must succeed in a blue/green virtualenv before switching to it
+	// Directory of wheels to install the requirements from, without a package index
+	Wheelhouse string
+	Backend    string // Name of the venvBackend that creates the virtualenv and installs into it, pip by default
+	// Run commands from a pre-installed Ansible at Prefix, or from $PATH if Prefix is empty, instead of a virtualenv
+	Disabled bool
+	Prefix   string // Install prefix of the pre-installed Ansible, with its executables in bin
 }
 
 // Takes a VenvConfig and will create a new virtual environment.
@@ -111,10 +148,21 @@ func getPythonVersion(python string) (string, error) {
 }
 
 // Ensure ensures that a virtual environment exists, if not, it attempts to create it
+//
+// Blue/green virtualenvs are created by Update instead, once it is known what to install into them.
 func (c VenvConfig) Ensure() error {
-	_, err := os.Stat(c.Path)
+	if c.Disabled || c.BlueGreen {
+		return nil
+	}
+
+	backend, err := newVenvBackend(c.Backend)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(c.Path)
 	if os.IsNotExist(err) {
-		err := makeVenv(c)
+		err := backend.create(c)
 		if err != nil {
 			return err
 		}
@@ -123,25 +171,265 @@ func (c VenvConfig) Ensure() error {
 	return nil
 }
 
-// Update updates the virtualenv for the given config with the specified requirements file
-func (c VenvConfig) Update(requirementsFile string) error {
+// Update updates the virtualenv for the given config with the specified requirements file,
+// or whatever file the backend installs from.
+//
+// Installing is skipped if the requirements file, the Python version and the pip version (or the version of the
+// backend's tool) are the same as for the last successful update. Returns whether the backend installed.
+func (c VenvConfig) Update(requirementsFile string) (bool, error) {
+	if c.Disabled {
+		return false, nil
+	}
+
+	if _, err := os.Stat(requirementsFile); err != nil {
+		return false, errors.Wrap(err, "unable to read requirements")
+	}
+
+	if c.BlueGreen {
+		return c.updateBlueGreen(requirementsFile)
+	}
+
+	upToDate, err := c.upToDate(requirementsFile)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to determine virtualenv state")
+	}
+	if upToDate {
+		logrus.Debugln("Requirements, Python and pip unchanged, skipping pip install")
+		return false, nil
+	}
+
+	return true, c.install(requirementsFile)
+}
+
+// upToDate returns whether the virtualenv was last updated from the same inputs.
+// An error means that the inputs could not be determined, e.g. because the virtualenv is broken.
+func (c VenvConfig) upToDate(requirementsFile string) (bool, error) {
+	recorded, err := readVenvState(filepath.Join(c.Path, venvStateFile))
+	if err != nil {
+		// Never updated successfully, e.g. because the virtualenv was only just created
+		return false, nil
+	}
+
+	state, err := c.state(requirementsFile)
+	if err != nil {
+		return false, err
+	}
+
+	return recorded == state, nil
+}
+
+// install installs the requirements file with the backend, and records the state of the virtualenv if it succeeded
+func (c VenvConfig) install(requirementsFile string) error {
+	backend, err := newVenvBackend(c.Backend)
+	if err != nil {
+		return err
+	}
+
+	// A failed update must never be skipped on the next run
+	statePath := filepath.Join(c.Path, venvStateFile)
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove virtualenv state")
+	}
+
+	if c.Wheelhouse != "" {
+		logrus.Infoln("Installing requirements from wheelhouse ", c.Wheelhouse)
+	}
+	if err := backend.install(c, requirementsFile); err != nil {
+		return err
+	}
+
+	// pip may have upgraded itself, so the state is only determined now
+	state, err := c.state(requirementsFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to determine virtualenv state")
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(statePath, data, 0644); err != nil {
+		logrus.Warnln("Unable to record virtualenv state, the next run will update it again: ", err)
+	}
+
+	return nil
+}
+
+// state returns the current inputs of an update of the virtualenv
+func (c VenvConfig) state(requirementsFile string) (venvState, error) {
+	backend, err := newVenvBackend(c.Backend)
+	if err != nil {
+		return venvState{}, err
+	}
+
+	requirements, err := backend.checksum(requirementsFile)
+	if err != nil {
+		return venvState{}, errors.Wrap(err, "unable to hash requirements")
+	}
+
+	pythonVersion, err := getPythonVersion(filepath.Join(c.Path, "bin", "python"))
+	if err != nil {
+		return venvState{}, errors.Wrap(err, "unable to determine Python version")
+	}
+
+	toolVersion, err := backend.version(c)
+	if err != nil {
+		return venvState{}, errors.Wrap(err, "unable to determine installer version")
+	}
+
+	return venvState{
+		Backend:       c.Backend,
+		Requirements:  requirements,
+		PythonVersion: pythonVersion,
+		ToolVersion:   toolVersion,
+	}, nil
+}
+
+// runInstall runs the install command of a backend, explaining failures due to the wheelhouse
+func (c VenvConfig) runInstall(vCmd VenvCommand) error {
+	venvCommandOutput := vCmd.Run()
+	if venvCommandOutput.Error != nil {
+		if c.Wheelhouse != "" {
+			if err := c.missingWheelError(venvCommandOutput.Stderr); err != nil {
+				return err
+			}
+		}
+		return errors.Wrap(venvCommandOutput.Error, "unable to update virtualenv")
+	}
+
+	return nil
+}
+
+// pipVersion returns the version of pip in the virtualenv, from output like "pip 23.0.1 from /venv/... (python 3.11)"
+func (c VenvConfig) pipVersion() (string, error) {
 	vCmd := VenvCommand{
 		Config: c,
 		Binary: "pip",
-		Args:   []string{"install", "-r", requirementsFile},
+		Args:   []string{"--version"},
 	}
 	venvCommandOutput := vCmd.Run()
 	if venvCommandOutput.Error != nil {
-		return errors.Wrap(venvCommandOutput.Error, "unable to update virtualenv")
+		return "", venvCommandOutput.Error
+	}
+
+	parts := strings.Fields(venvCommandOutput.Stdout)
+	if len(parts) < 2 {
+		return "", errors.New("unexpected output from pip version command")
+	}
+
+	return parts[1], nil
+}
+
+// missingWheelError explains a pip install from the wheelhouse that failed because a requirement had no wheel,
+// which usually means that the bundle only ships wheels built for a different Python version or platform.
+// Returns nil if pip failed for another reason.
+func (c VenvConfig) missingWheelError(pipStderr string) error {
+	match := pipNoMatchingDistribution.FindStringSubmatch(pipStderr)
+	if match == nil {
+		return nil
+	}
+	requirement := match[1]
+	name := normalizePackageName(strings.TrimSpace(requirementNameEnd.Split(requirement, 2)[0]))
+
+	abi := "unknown"
+	if pythonVersion, err := getPythonVersion(filepath.Join(c.Path, "bin", "python")); err == nil {
+		if parts := strings.Split(pythonVersion, "."); len(parts) >= 2 {
+			abi = "cp" + parts[0] + parts[1]
+		}
+	}
+
+	wheels := []string{}
+	if files, err := ioutil.ReadDir(c.Wheelhouse); err == nil {
+		for _, file := range files {
+			if normalizePackageName(strings.SplitN(file.Name(), "-", 2)[0]) == name {
+				wheels = append(wheels, file.Name())
+			}
+		}
+	}
+	if len(wheels) == 0 {
+		return fmt.Errorf("wheelhouse %s has no wheel for %s", c.Wheelhouse, requirement)
+	}
+
+	return fmt.Errorf("wheelhouse %s has no wheel for %s that is compatible with this host's Python ABI (%s), found: %s",
+		c.Wheelhouse, requirement, abi, strings.Join(wheels, ", "))
+}
+
+// normalizePackageName normalizes a Python package name as in PEP 503, and the way wheel file names spell it
+func normalizePackageName(name string) string {
+	return strings.ToLower(packageNameSeparators.ReplaceAllString(name, "_"))
+}
+
+func readVenvState(path string) (venvState, error) {
+	var state venvState
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+
+	return state, err
+}
+
+// requirementsChecksum hashes a requirements file along with the requirements and constraints files it includes,
+// as a change to any of them changes what pip installs.
+func requirementsChecksum(requirementsFile string) (string, error) {
+	hash := sha256.New()
+	if err := hashRequirements(hash, requirementsFile, map[string]bool{}); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func hashRequirements(w io.Writer, requirementsFile string, seen map[string]bool) error {
+	if seen[requirementsFile] {
+		return nil
+	}
+	seen[requirementsFile] = true
+
+	data, err := ioutil.ReadFile(requirementsFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", filepath.Base(requirementsFile))
+	w.Write(data)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		match := requirementsIncludeLine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || strings.Contains(match[1], "://") {
+			continue
+		}
+
+		// Included files are relative to the file that includes them
+		included := match[1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(requirementsFile), included)
+		}
+		if err := hashRequirements(w, included, seen); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// binDir returns the directory with the executables of the virtualenv or the install prefix,
+// or "" if commands are run from $PATH
+func (c VenvConfig) binDir() string {
+	if !c.Disabled {
+		return filepath.Join(c.Path, "bin")
+	}
+	if c.Prefix != "" {
+		return filepath.Join(c.Prefix, "bin")
+	}
+
+	return ""
+}
+
 // VenvCommand enables you to run a system command in a virtualenv.
 type VenvCommand struct {
 	Config       VenvConfig
-	Binary       string   // path to the binary under $venv/bin
+	Binary       string   // path to the binary under $venv/bin (or the install prefix, or $PATH), or an absolute path
 	Args         []string // args to pass to the command that is called
 	Cwd          string   // Directory to change to, if needed
 	Env          []string // Additions to the runtime environment
@@ -190,17 +478,22 @@ func (c VenvCommand) Run() VenvCommandRunOutput {
 		return CommandOutput
 	}
 
-	// Updating $PATH variable to include the venv path
-	venvPath := filepath.Join(c.Config.Path, "bin")
-	if !strings.Contains(path, venvPath) {
-		newVenvPath := fmt.Sprintf("%s:%s", filepath.Join(c.Config.Path, "bin"), path)
-		logrus.Debugln("PATH: ", newVenvPath)
-		os.Setenv("PATH", newVenvPath)
+	// Updating $PATH variable of the command to include the venv path, without changing it for other virtualenvs
+	venvPath := c.Config.binDir()
+	if venvPath != "" && !strings.Contains(path, venvPath) {
+		path = fmt.Sprintf("%s:%s", venvPath, path)
+		logrus.Debugln("PATH: ", path)
+	}
+
+	// Without a bin dir, the binary is looked up in $PATH
+	binary := c.Binary
+	if venvPath != "" && !filepath.IsAbs(binary) {
+		binary = filepath.Join(venvPath, binary)
 	}
 
 	cmd := exec.CommandContext(
 		ctx,
-		filepath.Join(c.Config.Path, "bin", c.Binary),
+		binary,
 		c.Args...,
 	)
 
@@ -208,7 +501,7 @@ func (c VenvCommand) Run() VenvCommandRunOutput {
 		cmd.Dir = c.Cwd
 	}
 
-	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Env = append(append(os.Environ(), "PATH="+path), c.Env...)
 
 	if c.StreamOutput {
 		stdout, _ := cmd.StdoutPipe()
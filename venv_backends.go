@@ -0,0 +1,220 @@
+// Environment backends, which create virtualenvs and install the requirements into them
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	venvBackendPip     = "pip"      // python -m venv (or virtualenv) and pip install -r
+	venvBackendUv      = "uv"       // uv venv and uv pip sync
+	venvBackendPipSync = "pip-sync" // python -m venv (or virtualenv) and pip-sync from pip-tools
+	venvBackendTarball = "tarball"  // A pre-built virtualenv, extracted from an archive in the bundle
+)
+
+// venvBackend creates virtualenvs and installs into them
+type venvBackend interface {
+	// create creates a new virtualenv at the path of the config
+	create(c VenvConfig) error
+	// install makes the virtualenv match the given file, e.g. a requirements file, a lockfile or an archive
+	install(c VenvConfig, file string) error
+	// version returns the version of the tool that installs, as installing with another version may give other results
+	version(c VenvConfig) (string, error)
+	// checksum returns the digest of the file and everything it refers to
+	checksum(file string) (string, error)
+}
+
+// newVenvBackend returns the backend with the given name, the empty name being pip
+func newVenvBackend(name string) (venvBackend, error) {
+	switch name {
+	case "", venvBackendPip:
+		return pipBackend{}, nil
+	case venvBackendUv:
+		return uvBackend{}, nil
+	case venvBackendPipSync:
+		return pipSyncBackend{}, nil
+	case venvBackendTarball:
+		return tarballBackend{limits: newExtractLimits()}, nil
+	}
+
+	return nil, fmt.Errorf("unknown virtualenv backend '%s', must be one of %s, %s, %s or %s",
+		name, venvBackendPip, venvBackendUv, venvBackendPipSync, venvBackendTarball)
+}
+
+// wheelhouseArgs returns the arguments for pip and compatible tools to only install from the wheelhouse, if any
+func wheelhouseArgs(c VenvConfig) []string {
+	if c.Wheelhouse == "" {
+		return nil
+	}
+
+	return []string{"--no-index", "--find-links", c.Wheelhouse}
+}
+
+// toolVersion returns the first line that the tool prints for its version flag
+func toolVersion(tool string) (string, error) {
+	output, err := exec.Command(tool, "--version").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to execute %s version command", tool)
+	}
+
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]), nil
+}
+
+// pipBackend installs requirements incrementally with pip install -r
+type pipBackend struct{}
+
+func (pipBackend) create(c VenvConfig) error {
+	return makeVenv(c)
+}
+
+func (pipBackend) install(c VenvConfig, requirementsFile string) error {
+	vCmd := VenvCommand{
+		Config: c,
+		Binary: "pip",
+		Args:   append([]string{"install", "-r", requirementsFile}, wheelhouseArgs(c)...),
+	}
+
+	return c.runInstall(vCmd)
+}
+
+func (pipBackend) version(c VenvConfig) (string, error) {
+	return c.pipVersion()
+}
+
+func (pipBackend) checksum(requirementsFile string) (string, error) {
+	return requirementsChecksum(requirementsFile)
+}
+
+// pipSyncBackend installs a lockfile with pip-sync, which also uninstalls anything that is not in the lockfile
+type pipSyncBackend struct{}
+
+func (pipSyncBackend) create(c VenvConfig) error {
+	return makeVenv(c)
+}
+
+func (pipSyncBackend) install(c VenvConfig, lockfile string) error {
+	pipSync, err := exec.LookPath("pip-sync")
+	if err != nil {
+		return errors.Wrap(err, "pip-sync not found in path")
+	}
+
+	// pip-sync is not installed in the virtualenv, so it is pointed to the virtualenv's Python
+	args := append([]string{"--python-executable", filepath.Join(c.Path, "bin", "python")}, wheelhouseArgs(c)...)
+	vCmd := VenvCommand{
+		Config: c,
+		Binary: pipSync,
+		Args:   append(args, lockfile),
+	}
+
+	return c.runInstall(vCmd)
+}
+
+func (pipSyncBackend) version(c VenvConfig) (string, error) {
+	pipVersion, err := c.pipVersion()
+	if err != nil {
+		return "", err
+	}
+	pipSyncVersion, err := toolVersion("pip-sync")
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s, pip %s", pipSyncVersion, pipVersion), nil
+}
+
+func (pipSyncBackend) checksum(requirementsFile string) (string, error) {
+	return requirementsChecksum(requirementsFile)
+}
+
+// uvBackend creates virtualenvs with uv and installs a lockfile with uv pip sync
+type uvBackend struct{}
+
+func (uvBackend) create(c VenvConfig) error {
+	cmd := exec.Command("uv", "venv", "--python", c.Python, c.Path)
+	if err := cmd.Run(); err != nil {
+		failedCommandLogger(cmd)
+		return errors.Wrap(err, "unable to create virtual environment")
+	}
+
+	return nil
+}
+
+func (uvBackend) install(c VenvConfig, lockfile string) error {
+	uv, err := exec.LookPath("uv")
+	if err != nil {
+		return errors.Wrap(err, "uv not found in path")
+	}
+
+	args := append([]string{"pip", "sync", "--python", filepath.Join(c.Path, "bin", "python")}, wheelhouseArgs(c)...)
+	vCmd := VenvCommand{
+		Config: c,
+		Binary: uv,
+		Args:   append(args, lockfile),
+	}
+
+	return c.runInstall(vCmd)
+}
+
+func (uvBackend) version(VenvConfig) (string, error) {
+	return toolVersion("uv")
+}
+
+func (uvBackend) checksum(requirementsFile string) (string, error) {
+	return requirementsChecksum(requirementsFile)
+}
+
+// tarballBackend replaces the virtualenv with one that was built ahead of time and shipped in the bundle.
+//
+// Scripts in a virtualenv refer to the path it was built at, so it must have been built at the virtualenv path,
+// with --copies so that it does not contain symlinks out of the virtualenv.
+type tarballBackend struct {
+	limits extractLimits
+}
+
+func (tarballBackend) create(c VenvConfig) error {
+	return os.MkdirAll(c.Path, 0755)
+}
+
+// stagedVenvPath is where a virtualenv archive is extracted until it replaces the virtualenv.
+// It is hidden, so that it is never mistaken for a blue/green virtualenv slot.
+func stagedVenvPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".extract")
+}
+
+func (b tarballBackend) install(c VenvConfig, archive string) error {
+	// A corrupt or oversized archive must not cost the working virtualenv
+	stagedPath := stagedVenvPath(c.Path)
+	if err := os.RemoveAll(stagedPath); err != nil {
+		return errors.Wrap(err, "unable to remove stale extraction")
+	}
+	if err := extractArchive(archive, stagedPath, b.limits); err != nil {
+		os.RemoveAll(stagedPath)
+		return errors.Wrap(err, "unable to extract virtualenv")
+	}
+
+	if err := os.RemoveAll(c.Path); err != nil {
+		os.RemoveAll(stagedPath)
+		return errors.Wrap(err, "unable to replace virtualenv")
+	}
+	if err := os.Rename(stagedPath, c.Path); err != nil {
+		return errors.Wrap(err, "unable to replace virtualenv")
+	}
+
+	return nil
+}
+
+func (tarballBackend) version(VenvConfig) (string, error) {
+	// Nothing is installed, the virtualenv only depends on the archive
+	return "", nil
+}
+
+func (tarballBackend) checksum(archive string) (string, error) {
+	return fileChecksum(archive, "sha256")
+}
@@ -0,0 +1,237 @@
+// Blue/green virtualenvs: changed requirements are installed into a new virtualenv next to the live one,
+// and the virtualenv path is only switched over to it once it works.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Name of the virtualenv that was at the virtualenv path before blue/green virtualenvs were enabled
+const venvLegacySlot = "legacy"
+
+// slotPath returns the path of the virtualenv slot with the given name, next to the virtualenv path
+func (c VenvConfig) slotPath(name string) string {
+	return fmt.Sprintf("%s.slot-%s", c.Path, name)
+}
+
+// slot returns the config of the virtualenv in a slot
+func (c VenvConfig) slot(path string) VenvConfig {
+	slot := c
+	slot.Path = path
+	slot.BlueGreen = false
+	return slot
+}
+
+// updateBlueGreen updates blue/green virtualenvs, where the virtualenv path is a symlink to the live slot.
+//
+// If the live virtualenv is not up to date, a new one is built in a new slot and smoke tested before the symlink
+// is switched over to it, so a failed update leaves the live virtualenv untouched. The previous virtualenv is kept,
+// and is switched back to automatically should the live one break.
+func (c VenvConfig) updateBlueGreen(requirementsFile string) (bool, error) {
+	live, err := c.liveSlot()
+	if err != nil {
+		return false, err
+	}
+
+	broken := ""
+	if live != "" {
+		upToDate, err := c.slot(live).upToDate(requirementsFile)
+		if err != nil {
+			logrus.Warnf("Live virtualenv %s is broken: %v", live, err)
+			broken = live
+			live, upToDate = c.fallBack(broken, requirementsFile)
+			if live == "" {
+				logrus.Errorf("Live virtualenv %s is broken and no previous virtualenv works, building a new one", broken)
+			}
+		}
+		if upToDate {
+			logrus.Debugln("Requirements, Python and pip unchanged, skipping pip install")
+			return false, nil
+		}
+	}
+
+	next, err := ioutil.TempDir(filepath.Dir(c.Path), filepath.Base(c.slotPath("")))
+	if err != nil {
+		return false, errors.Wrap(err, "unable to create virtualenv slot")
+	}
+	logrus.Infof("Building virtualenv %s", next)
+	if err := c.build(next, requirementsFile); err != nil {
+		os.RemoveAll(next)
+		if live != "" {
+			return true, errors.Wrapf(err, "unable to build new virtualenv, keeping %s", live)
+		}
+		if broken != "" {
+			return true, errors.Wrapf(err, "unable to build new virtualenv to replace broken %s", broken)
+		}
+		return true, errors.Wrap(err, "unable to build virtualenv")
+	}
+
+	if err := c.switchTo(next); err != nil {
+		os.RemoveAll(next)
+		return true, err
+	}
+	logrus.Infof("Switched virtualenv to %s", next)
+
+	c.prune(next, live)
+
+	return true, nil
+}
+
+// liveSlot returns the path of the live virtualenv, or "" if there is none yet.
+//
+// A virtualenv directory at the virtualenv path, from before blue/green virtualenvs were enabled,
+// is moved into a slot.
+func (c VenvConfig) liveSlot() (string, error) {
+	info, err := os.Lstat(c.Path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		legacy := c.slotPath(venvLegacySlot)
+		logrus.Infof("Moving virtualenv %s to %s", c.Path, legacy)
+		if err := os.RemoveAll(legacy); err != nil {
+			return "", errors.Wrap(err, "unable to move virtualenv into a slot")
+		}
+		if err := os.Rename(c.Path, legacy); err != nil {
+			return "", errors.Wrap(err, "unable to move virtualenv into a slot")
+		}
+		// Scripts in the virtualenv refer to the virtualenv path, which is going to point to the slot
+		return legacy, c.switchTo(legacy)
+	}
+
+	target, err := filepath.EvalSymlinks(c.Path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return target, err
+}
+
+// build creates a new virtualenv in the empty dir at path, installs the requirements and smoke tests it
+func (c VenvConfig) build(path, requirementsFile string) error {
+	slot := c.slot(path)
+	if err := os.Chmod(path, 0755); err != nil {
+		return err
+	}
+	backend, err := newVenvBackend(c.Backend)
+	if err != nil {
+		return err
+	}
+	if err := backend.create(slot); err != nil {
+		return err
+	}
+	if err := slot.install(requirementsFile); err != nil {
+		return err
+	}
+
+	return slot.smokeTest()
+}
+
+// smokeTest runs the smoke test command in the virtualenv
+func (c VenvConfig) smokeTest() error {
+	if len(c.SmokeTest) == 0 {
+		return nil
+	}
+
+	vCmd := VenvCommand{
+		Config: c,
+		Binary: c.SmokeTest[0],
+		Args:   c.SmokeTest[1:],
+	}
+	if output := vCmd.Run(); output.Error != nil {
+		return errors.Wrapf(output.Error, "smoke test '%s' failed: %s", c.SmokeTest, output.Stderr)
+	}
+
+	return nil
+}
+
+// switchTo atomically points the virtualenv path to the virtualenv at path
+func (c VenvConfig) switchTo(path string) error {
+	link := c.Path + ".switch"
+	os.Remove(link)
+
+	// Relative, so that the virtualenvs can be moved along with the link
+	if err := os.Symlink(filepath.Base(path), link); err != nil {
+		return errors.Wrap(err, "unable to switch virtualenv")
+	}
+	if err := os.Rename(link, c.Path); err != nil {
+		os.Remove(link)
+		return errors.Wrap(err, "unable to switch virtualenv")
+	}
+
+	return nil
+}
+
+// slots returns the paths of all virtualenv slots, most recently modified first
+func (c VenvConfig) slots() []string {
+	paths, _ := filepath.Glob(c.slotPath("*"))
+
+	modTimes := map[string]time.Time{}
+	slots := []string{}
+	for _, path := range paths {
+		if info, err := os.Lstat(path); err == nil && info.IsDir() {
+			modTimes[path] = info.ModTime()
+			slots = append(slots, path)
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return modTimes[slots[i]].After(modTimes[slots[j]]) })
+
+	return slots
+}
+
+// fallBack switches to the most recent working virtualenv other than the broken one.
+// Returns the new live virtualenv, or "" if there is none, and whether it is up to date.
+func (c VenvConfig) fallBack(broken, requirementsFile string) (string, bool) {
+	for _, path := range c.slots() {
+		if path == broken {
+			continue
+		}
+
+		slot := c.slot(path)
+		upToDate, err := slot.upToDate(requirementsFile)
+		if err == nil {
+			err = slot.smokeTest()
+		}
+		if err != nil {
+			logrus.Warnf("Virtualenv %s does not work either: %v", path, err)
+			continue
+		}
+
+		if err := c.switchTo(path); err != nil {
+			logrus.Warnln("Unable to fall back to a previous virtualenv: ", err)
+			return "", false
+		}
+		logrus.Warnf("Fell back to virtualenv %s", path)
+		promVenvFallbacks.Inc()
+
+		return path, upToDate
+	}
+
+	return "", false
+}
+
+// prune removes all virtualenv slots except the live and the previous one
+func (c VenvConfig) prune(live, previous string) {
+	for _, path := range c.slots() {
+		if path == live || path == previous {
+			continue
+		}
+
+		logrus.Infof("Removing virtualenv %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			logrus.Warnf("Unable to remove virtualenv %s: %v", path, err)
+		}
+	}
+}
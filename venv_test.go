@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// Register the below test suite
+func TestVenvTestSuite(t *testing.T) {
+	suite.Run(t, new(VenvTestSuite))
+}
+
+// VenvTestSuite runs against a fake virtualenv, whose pip records its invocations instead of installing anything
+type VenvTestSuite struct {
+	suite.Suite
+	tmpDir       string
+	venv         VenvConfig
+	binDir       string // Where the fake python and pip are, which is copied into blue/green virtualenvs
+	pipLog       string
+	requirements string
+}
+
+// writeScript writes an executable shell script
+func writeScript(t *testing.T, path, script string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+}
+
+func (s *VenvTestSuite) SetupTest() {
+	var err error
+	s.tmpDir, err = ioutil.TempDir("", "ansible_puller")
+	assert.Nil(s.T(), err)
+
+	s.venv = VenvConfig{Path: filepath.Join(s.tmpDir, "venv")}
+	s.binDir = filepath.Join(s.venv.Path, "bin")
+	s.pipLog = filepath.Join(s.tmpDir, "pip.log")
+
+	writeScript(s.T(), filepath.Join(s.binDir, "python"), `echo "Python 3.11.2"`)
+	s.writePip("23.0.1", 0)
+
+	s.requirements = filepath.Join(s.tmpDir, "bundle", "requirements.txt")
+	assert.Nil(s.T(), os.MkdirAll(filepath.Dir(s.requirements), 0755))
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.0.0\n-c constraints.txt\n"), 0644))
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.tmpDir, "bundle", "constraints.txt"), []byte("jinja2<4\n"), 0644))
+}
+
+func (s *VenvTestSuite) TearDownTest() {
+	os.RemoveAll(s.tmpDir)
+}
+
+// writePip writes a fake pip with the given version, whose installs exit with exitCode
+func (s *VenvTestSuite) writePip(version string, exitCode int) {
+	writeScript(s.T(), filepath.Join(s.binDir, "pip"), fmt.Sprintf(`
+if [ "$1" = "--version" ]; then
+	echo "pip %s from /venv/lib/python3.11/site-packages/pip (python 3.11)"
+	exit 0
+fi
+echo "$@" >> %s
+exit %d
+`, version, s.pipLog, exitCode))
+}
+
+// installs returns the number of times pip install was run
+func (s *VenvTestSuite) installs() int {
+	data, err := ioutil.ReadFile(s.pipLog)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	assert.Nil(s.T(), err)
+	return strings.Count(string(data), "install")
+}
+
+func (s *VenvTestSuite) update() bool {
+	updated, err := s.venv.Update(s.requirements)
+	assert.Nil(s.T(), err)
+	return updated
+}
+
+func (s *VenvTestSuite) TestUpdateSkipsUnchangedRequirements() {
+	assert.True(s.T(), s.update())
+	assert.False(s.T(), s.update(), "unchanged requirements should not be installed again")
+	assert.Equal(s.T(), 1, s.installs())
+
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.1.0\n-c constraints.txt\n"), 0644))
+	assert.True(s.T(), s.update(), "changed requirements should be installed")
+
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.tmpDir, "bundle", "constraints.txt"), []byte("jinja2<3\n"), 0644))
+	assert.True(s.T(), s.update(), "changed constraints should be installed")
+
+	s.writePip("23.1", 0)
+	assert.True(s.T(), s.update(), "a different pip version should install again")
+	assert.False(s.T(), s.update())
+	assert.Equal(s.T(), 4, s.installs())
+}
+
+func (s *VenvTestSuite) TestFailedUpdateIsRetried() {
+	assert.True(s.T(), s.update())
+
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.1.0\n"), 0644))
+	s.writePip("23.0.1", 1)
+	updated, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.True(s.T(), updated)
+
+	s.writePip("23.0.1", 0)
+	assert.True(s.T(), s.update(), "failed update should be retried")
+	assert.Equal(s.T(), 3, s.installs())
+}
+
+func (s *VenvTestSuite) TestMissingRequirements() {
+	_, err := s.venv.Update(filepath.Join(s.tmpDir, "missing.txt"))
+	assert.NotNil(s.T(), err)
+	assert.Equal(s.T(), 0, s.installs())
+}
+
+func (s *VenvTestSuite) TestWheelhouse() {
+	s.venv.Wheelhouse = filepath.Join(s.tmpDir, "bundle", "wheelhouse")
+	assert.True(s.T(), s.update())
+
+	data, err := ioutil.ReadFile(s.pipLog)
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), string(data), "--no-index --find-links "+s.venv.Wheelhouse)
+}
+
+func (s *VenvTestSuite) TestWheelhouseMissingWheel() {
+	s.venv.Wheelhouse = filepath.Join(s.tmpDir, "bundle", "wheelhouse")
+	assert.Nil(s.T(), os.MkdirAll(s.venv.Wheelhouse, 0755))
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.venv.Wheelhouse, "PyYAML-6.0-cp310-cp310-manylinux_2_17_x86_64.whl"), nil, 0644))
+	writeScript(s.T(), filepath.Join(s.binDir, "pip"), `
+if [ "$1" = "--version" ]; then
+	echo "pip 23.0.1 from /venv/lib/python3.11/site-packages/pip (python 3.11)"
+	exit 0
+fi
+echo "ERROR: Could not find a version that satisfies the requirement pyyaml==6.0 (from versions: none)" >&2
+echo "ERROR: No matching distribution found for pyyaml==6.0" >&2
+exit 1
+`)
+
+	_, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "no wheel for pyyaml==6.0 that is compatible with this host's Python ABI (cp311)")
+	assert.Contains(s.T(), err.Error(), "PyYAML-6.0-cp310-cp310-manylinux_2_17_x86_64.whl")
+}
+
+func (s *VenvTestSuite) TestTarballBackend() {
+	archive := filepath.Join(s.tmpDir, "bundle", "venv.tar.gz")
+	assert.Nil(s.T(), exec.Command("tar", "-czf", archive, "-C", s.venv.Path, ".").Run())
+	assert.Nil(s.T(), os.RemoveAll(s.venv.Path))
+
+	s.venv.Backend = venvBackendTarball
+	assert.Nil(s.T(), s.venv.Ensure())
+	updated, err := s.venv.Update(archive)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), updated)
+	_, err = os.Stat(filepath.Join(s.venv.Path, "bin", "pip"))
+	assert.Nil(s.T(), err)
+
+	updated, err = s.venv.Update(archive)
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), updated, "unchanged archive should not be extracted again")
+	assert.Equal(s.T(), 0, s.installs())
+
+	corrupt, err := ioutil.ReadFile("testdata/corrupt.tgz")
+	assert.Nil(s.T(), err)
+	assert.Nil(s.T(), ioutil.WriteFile(archive, corrupt, 0644))
+	_, err = s.venv.Update(archive)
+	assert.NotNil(s.T(), err)
+	_, err = os.Stat(filepath.Join(s.venv.Path, "bin", "pip"))
+	assert.Nil(s.T(), err, "virtualenv should be kept when the archive cannot be extracted")
+	_, err = os.Stat(stagedVenvPath(s.venv.Path))
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
+func (s *VenvTestSuite) TestUvBackend() {
+	uvLog := filepath.Join(s.tmpDir, "uv.log")
+	bin := filepath.Join(s.tmpDir, "tools")
+	writeScript(s.T(), filepath.Join(bin, "uv"), fmt.Sprintf(`
+if [ "$1" = "--version" ]; then
+	echo "uv 0.4.0"
+	exit 0
+fi
+echo "$@" >> %s
+`, uvLog))
+	s.T().Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	s.venv.Backend = venvBackendUv
+	s.venv.Wheelhouse = filepath.Join(s.tmpDir, "bundle", "wheelhouse")
+	assert.True(s.T(), s.update())
+	assert.False(s.T(), s.update())
+
+	data, err := ioutil.ReadFile(uvLog)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("pip sync --python %s --no-index --find-links %s %s\n",
+		filepath.Join(s.venv.Path, "bin", "python"), s.venv.Wheelhouse, s.requirements), string(data))
+
+	state, err := readVenvState(filepath.Join(s.venv.Path, venvStateFile))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), "uv 0.4.0", state.ToolVersion)
+}
+
+func (s *VenvTestSuite) TestUnknownBackend() {
+	s.venv.Backend = "conda"
+	assert.NotNil(s.T(), s.venv.Ensure())
+	_, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.Equal(s.T(), 0, s.installs())
+}
+
+func (s *VenvTestSuite) TestDisabledSkipsVirtualenv() {
+	s.venv = VenvConfig{Path: filepath.Join(s.tmpDir, "missing"), Disabled: true}
+	assert.Nil(s.T(), s.venv.Ensure())
+	assert.False(s.T(), s.update())
+
+	_, err := os.Stat(s.venv.Path)
+	assert.True(s.T(), os.IsNotExist(err), "no virtualenv should be created")
+	assert.Equal(s.T(), 0, s.installs())
+}
+
+// setupBlueGreen switches to blue/green virtualenvs, created by a fake system Python from the fake python and pip.
+// Their smoke test fails while the file "ansible-broken" exists.
+func (s *VenvTestSuite) setupBlueGreen() {
+	template := filepath.Join(s.tmpDir, "template")
+	assert.Nil(s.T(), os.Rename(s.venv.Path, template))
+	s.binDir = filepath.Join(template, "bin")
+	writeScript(s.T(), filepath.Join(s.binDir, "ansible"), fmt.Sprintf(`[ ! -e %s ]`, filepath.Join(s.tmpDir, "ansible-broken")))
+
+	python := filepath.Join(s.tmpDir, "python")
+	writeScript(s.T(), python, fmt.Sprintf(`
+if [ "$1" = "--version" ]; then
+	echo "Python 3.11.2"
+	exit 0
+fi
+cp -R %s "$3/"
+`, s.binDir))
+
+	s.venv = VenvConfig{Path: s.venv.Path, Python: python, BlueGreen: true, SmokeTest: []string{"ansible", "--version"}}
+}
+
+// live returns the virtualenv that venv-path points to
+func (s *VenvTestSuite) live() string {
+	live, err := filepath.EvalSymlinks(s.venv.Path)
+	assert.Nil(s.T(), err)
+	return live
+}
+
+func (s *VenvTestSuite) TestBlueGreenSwitchesOnChange() {
+	s.setupBlueGreen()
+
+	assert.True(s.T(), s.update())
+	first := s.live()
+	assert.True(s.T(), strings.HasPrefix(first, s.venv.Path+".slot-"))
+	assert.False(s.T(), s.update())
+	assert.Equal(s.T(), first, s.live())
+
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.1.0\n"), 0644))
+	assert.True(s.T(), s.update())
+	second := s.live()
+	assert.NotEqual(s.T(), first, second)
+
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.2.0\n"), 0644))
+	assert.True(s.T(), s.update())
+	assert.ElementsMatch(s.T(), []string{s.live(), second}, s.venv.slots(), "only the live and the previous virtualenv should be kept")
+	assert.Equal(s.T(), 3, s.installs())
+}
+
+func (s *VenvTestSuite) TestBlueGreenFailedSmokeTestKeepsLive() {
+	s.setupBlueGreen()
+	assert.True(s.T(), s.update())
+	live := s.live()
+
+	assert.Nil(s.T(), ioutil.WriteFile(filepath.Join(s.tmpDir, "ansible-broken"), nil, 0644))
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.1.0\n"), 0644))
+	updated, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "smoke test")
+	assert.True(s.T(), updated)
+
+	assert.Equal(s.T(), live, s.live(), "live virtualenv should be kept when the new one fails")
+	assert.Equal(s.T(), []string{live}, s.venv.slots(), "failed virtualenv should be removed")
+}
+
+func (s *VenvTestSuite) TestBlueGreenFallsBackToPrevious() {
+	s.setupBlueGreen()
+	assert.True(s.T(), s.update())
+	previous := s.live()
+	assert.Nil(s.T(), ioutil.WriteFile(s.requirements, []byte("ansible==8.1.0\n"), 0644))
+	assert.True(s.T(), s.update())
+
+	// Break the live virtualenv, and make sure that replacing it fails as well
+	assert.Nil(s.T(), os.Remove(filepath.Join(s.live(), "bin", "python")))
+	s.writePip("23.0.1", 1)
+
+	_, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.Equal(s.T(), previous, s.live(), "should fall back to the previous virtualenv")
+}
+
+func (s *VenvTestSuite) TestBlueGreenNoFallbackReportsBroken() {
+	s.setupBlueGreen()
+	assert.True(s.T(), s.update())
+	broken := s.live()
+
+	// The only virtualenv is broken, and replacing it fails
+	assert.Nil(s.T(), os.Remove(filepath.Join(broken, "bin", "python")))
+	s.writePip("23.0.1", 1)
+
+	_, err := s.venv.Update(s.requirements)
+	assert.NotNil(s.T(), err)
+	assert.Contains(s.T(), err.Error(), "to replace broken "+broken)
+}
+
+func (s *VenvTestSuite) TestBlueGreenMigratesExistingVenv() {
+	assert.True(s.T(), s.update())
+	s.setupBlueGreen()
+	// The existing virtualenv is up to date, and should be moved into a slot rather than rebuilt
+	assert.Nil(s.T(), os.Rename(filepath.Join(s.tmpDir, "template"), s.venv.Path))
+	assert.Nil(s.T(), os.MkdirAll(s.venv.Path+".unrelated", 0755))
+
+	assert.False(s.T(), s.update())
+	assert.Equal(s.T(), s.venv.slotPath(venvLegacySlot), s.live())
+	_, err := os.Stat(s.venv.Path + ".unrelated")
+	assert.Nil(s.T(), err)
+}